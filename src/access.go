@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+)
+
+// Access states stored on a sender's record by the invite flow.
+const (
+	AccessApproved = "approved"
+	AccessPending  = "pending"
+	AccessDenied   = "denied"
+)
+
+// How senders that are on neither list are treated.
+const (
+	// Anyone may use the bot.
+	AccessModeOpen = "open"
+	// Only allowlisted or approved senders may use the bot, others are ignored.
+	AccessModeAllowlist = "allowlist"
+	// Unknown senders are asked to wait while an admin approves them.
+	AccessModeInvite = "invite"
+)
+
+type AccessDecision int
+
+const (
+	AccessAllowed AccessDecision = iota
+	AccessRejected
+	// The sender was unknown and has just been queued for approval.
+	AccessRequested
+	// The sender is still waiting for an admin to approve them.
+	AccessAwaiting
+)
+
+// AccessControl decides who may talk to the bot and who may run privileged
+// commands. Senders are matched by phone number or Signal UUID.
+type AccessControl struct {
+	mode      string
+	allowlist []string
+	blocklist []string
+	admins    []string
+	sessions  *SessionManager
+}
+
+func newAccessControl(sessions *SessionManager) *AccessControl {
+	access := &AccessControl{
+		allowlist: envList("SIGNAL_ALLOWLIST"),
+		blocklist: envList("SIGNAL_BLOCKLIST"),
+		admins:    envList("SIGNAL_ADMINS"),
+		sessions:  sessions,
+	}
+
+	access.mode = os.Getenv("SIGNAL_ACCESS_MODE")
+	if access.mode == "" {
+		access.mode = AccessModeOpen
+		if len(access.allowlist) > 0 {
+			access.mode = AccessModeAllowlist
+		}
+	}
+	switch access.mode {
+	case AccessModeOpen, AccessModeAllowlist, AccessModeInvite:
+	default:
+		log.Fatalf("Unknown SIGNAL_ACCESS_MODE %q, expected open, allowlist or invite.", access.mode)
+	}
+
+	if len(access.admins) == 0 {
+		// Nobody could approve invite requests.
+		if access.mode == AccessModeInvite {
+			log.Fatal("SIGNAL_ACCESS_MODE is invite but SIGNAL_ADMINS is empty.")
+		}
+		log.Println("SIGNAL_ADMINS is empty, so nobody may run admin commands.")
+	}
+
+	return access
+}
+
+func (s Sender) matches(list []string) bool {
+	return (s.Number != "" && slices.Contains(list, s.Number)) ||
+		(s.Uuid != "" && slices.Contains(list, s.Uuid))
+}
+
+func (a *AccessControl) isAdmin(sender Sender) bool {
+	return sender.matches(a.admins)
+}
+
+func (a *AccessControl) storedAccess(sender Sender) string {
+	record, err := a.sessions.store.Get(sender.id())
+	if err != nil {
+		log.Println("Failed to load access for "+sender.id()+":", err)
+		return ""
+	}
+	if record == nil {
+		return ""
+	}
+	return record.Access
+}
+
+func (a *AccessControl) check(sender Sender) AccessDecision {
+	decision := a.decide(sender)
+	if decision == AccessRequested {
+		a.setAccess(sender.id(), AccessPending)
+	}
+	return decision
+}
+
+// Whether the sender may use the bot, without asking for access on their
+// behalf. Reactions and deletes are checked this way since they shouldn't
+// start an invite request.
+func (a *AccessControl) isAllowed(sender Sender) bool {
+	return a.decide(sender) == AccessAllowed
+}
+
+func (a *AccessControl) decide(sender Sender) AccessDecision {
+	if sender.matches(a.blocklist) {
+		return AccessRejected
+	}
+	if sender.matches(a.admins) || sender.matches(a.allowlist) {
+		return AccessAllowed
+	}
+
+	switch a.storedAccess(sender) {
+	case AccessApproved:
+		return AccessAllowed
+	case AccessDenied:
+		return AccessRejected
+	case AccessPending:
+		return AccessAwaiting
+	}
+
+	switch a.mode {
+	case AccessModeOpen:
+		return AccessAllowed
+	case AccessModeInvite:
+		return AccessRequested
+	default:
+		return AccessRejected
+	}
+}
+
+func (a *AccessControl) setAccess(id string, access string) {
+	a.sessions.update(id, func(record *SenderRecord) {
+		record.Access = access
+	})
+}
+
+func (a *AccessControl) pending() []string {
+	records, err := a.sessions.store.List()
+	if err != nil {
+		log.Println("Failed to list senders:", err)
+		return nil
+	}
+
+	pending := []string{}
+	for _, record := range records {
+		if record.Access == AccessPending {
+			pending = append(pending, record.Recipient)
+		}
+	}
+	slices.Sort(pending)
+	return pending
+}
+
+// Handles a message from a sender that may not use the bot yet. Returns true
+// if the message should be processed.
+func admitSender(access *AccessControl, sender Sender, accountNumber string) bool {
+	switch access.check(sender) {
+	case AccessAllowed:
+		return true
+	case AccessRequested:
+		log.Println("Access requested by", sender)
+		sendSignalMessage("Thanks for your message! An admin needs to approve you before I can reply, I'll let you know once they have.", accountNumber, sender.id())
+		notice := fmt.Sprintf("%s would like to use this bot. Reply !access approve %s or !access deny %s.", sender, sender.id(), sender.id())
+		for _, admin := range access.admins {
+			sendSignalMessage(notice, accountNumber, admin)
+		}
+	case AccessAwaiting:
+		log.Println("Ignoring message from", sender, "while they await approval.")
+	case AccessRejected:
+		log.Println("Ignoring message from", sender, "who is not allowed to use this bot.")
+	}
+	return false
+}
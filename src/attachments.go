@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// OutgoingAttachment is a file to send to Signal alongside a reply.
+type OutgoingAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// The format the REST API expects in base64_attachments.
+func (a OutgoingAttachment) dataURI() string {
+	return "data:" + a.ContentType + ";filename=" + a.Filename + ";base64," + base64.StdEncoding.EncodeToString(a.Data)
+}
+
+// Matches markdown images and links, capturing the leading "!" of images,
+// the text and the target.
+var markdownReferenceRegex = regexp.MustCompile(`(!?)\[([^\]]*)\]\(([^)\s]+)\)`)
+
+// Collects the files a reply refers to: images it embeds, links to files
+// stored in Open WebUI, and generated images attached to the message. Returns
+// the reply text with the references to successfully fetched files removed,
+// since they arrive as attachments instead.
+func replyAttachments(reply *OpenWebUIReply) (string, []OutgoingAttachment) {
+	text := reply.text()
+	attachments := []OutgoingAttachment{}
+	seen := map[string]bool{}
+	fetch := func(url, name string) bool {
+		if seen[url] {
+			return true
+		}
+		attachment, err := fetchAttachment(url, name)
+		if err != nil {
+			log.Println("Not attaching "+truncateForLog(url)+":", err)
+			return false
+		}
+		seen[url] = true
+		attachments = append(attachments, *attachment)
+		return true
+	}
+
+	for _, file := range reply.Files {
+		switch {
+		case file.URL != "":
+			fetch(file.URL, "")
+		case file.ID != "":
+			fetch("/api/v1/files/"+file.ID+"/content", "")
+		}
+	}
+
+	text = markdownReferenceRegex.ReplaceAllStringFunc(text, func(reference string) string {
+		parts := markdownReferenceRegex.FindStringSubmatch(reference)
+		isImage, label, url := parts[1] == "!", parts[2], parts[3]
+		if !isImage && !isOpenWebUIFileURL(url) {
+			return reference
+		}
+		if !fetch(url, label) {
+			return reference
+		}
+		if isImage {
+			return ""
+		}
+		return label
+	})
+
+	return strings.TrimSpace(text), attachments
+}
+
+func isOpenWebUIFileURL(url string) bool {
+	return strings.Contains(url, "/api/v1/files/")
+}
+
+func maxAttachmentBytes() int64 {
+	return int64(envInt("SIGNAL_MAX_ATTACHMENT_BYTES", 25*1024*1024))
+}
+
+// Longest a single attachment download may take.
+const attachmentTimeout = 30 * time.Second
+
+var openWebUIAttachmentClient = &http.Client{Timeout: attachmentTimeout}
+
+// Used for images from anywhere but Open WebUI. It refuses to connect to
+// the bot's own network, checking the resolved address so that names and
+// redirects pointing there are refused too.
+var webAttachmentClient = &http.Client{
+	Timeout: attachmentTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: 10 * time.Second, Control: refuseLocalAddress}).DialContext,
+	},
+}
+
+// Shared address space, used for cloud metadata by some providers.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func refuseLocalAddress(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || sharedAddressSpace.Contains(ip) {
+		return errors.New("refusing to fetch from local address " + ip.String())
+	}
+	return nil
+}
+
+// Images from other hosts are only fetched when SIGNAL_FETCH_WEB_IMAGES is
+// set, since the URLs come from the model or pages it searched.
+func fetchWebImages() bool {
+	return os.Getenv("SIGNAL_FETCH_WEB_IMAGES") == "1"
+}
+
+// Fetches a data URI, a file stored in Open WebUI, or with
+// SIGNAL_FETCH_WEB_IMAGES an image from the web, refusing anything larger
+// than SIGNAL_MAX_ATTACHMENT_BYTES.
+func fetchAttachment(url string, name string) (*OutgoingAttachment, error) {
+	if strings.HasPrefix(url, "data:") {
+		return decodeDataURI(url, name)
+	}
+
+	request := url
+	openWebUI := true
+	client := openWebUIAttachmentClient
+	switch {
+	case strings.HasPrefix(url, "/"):
+		request = "http://" + os.Getenv("OPENWEBUI_URL") + url
+	case strings.HasPrefix(url, "http://"+os.Getenv("OPENWEBUI_URL")+"/"):
+	case !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://"):
+		return nil, errors.New("unsupported URL")
+	case !fetchWebImages():
+		return nil, errors.New("not an Open WebUI file and SIGNAL_FETCH_WEB_IMAGES is off")
+	default:
+		openWebUI = false
+		client = webAttachmentClient
+	}
+
+	req, err := http.NewRequest("GET", request, nil)
+	if err != nil {
+		return nil, err
+	}
+	if openWebUI {
+		req.Header.Set("Authorization", "Bearer "+os.Getenv("OPENWEBUI_API_KEY"))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("server returned " + resp.Status)
+	}
+	limit := maxAttachmentBytes()
+	if resp.ContentLength > limit {
+		return nil, fmt.Errorf("%d bytes is over the %d byte limit", resp.ContentLength, limit)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("over the %d byte limit", limit)
+	}
+
+	filename := name
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		filename = params["filename"]
+	}
+	if filename == "" {
+		filename = path.Base(resp.Request.URL.Path)
+	}
+
+	attachment := newOutgoingAttachment(filename, resp.Header.Get("Content-Type"), data)
+	// Models happily link to anything, so only images are taken from the web.
+	if !openWebUI && !strings.HasPrefix(attachment.ContentType, "image/") {
+		return nil, errors.New("not an image: " + attachment.ContentType)
+	}
+	return attachment, nil
+}
+
+func decodeDataURI(uri string, name string) (*OutgoingAttachment, error) {
+	header, encoded, found := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !found || !strings.HasSuffix(header, ";base64") {
+		return nil, errors.New("only base64 data URIs are supported")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxAttachmentBytes() {
+		return nil, fmt.Errorf("over the %d byte limit", maxAttachmentBytes())
+	}
+	contentType := strings.Split(strings.TrimSuffix(header, ";base64"), ";")[0]
+	return newOutgoingAttachment(name, contentType, data), nil
+}
+
+// Go's built in MIME table has no audio types, and systems without a
+// mime.types file would send speech without an extension.
+var audioExtensions = map[string]string{
+	"audio/aac":  ".aac",
+	"audio/mpeg": ".mp3",
+	"audio/ogg":  ".ogg",
+	"audio/opus": ".opus",
+	"audio/wav":  ".wav",
+	"audio/mp4":  ".m4a",
+}
+
+// Works out the MIME type from the content itself, falling back to what the
+// server claimed, and makes sure the filename has a matching extension.
+func newOutgoingAttachment(filename string, claimedType string, data []byte) *OutgoingAttachment {
+	contentType := http.DetectContentType(data)
+	if claimed, _, err := mime.ParseMediaType(claimedType); err == nil && claimed != "" &&
+		(contentType == "application/octet-stream" || strings.HasPrefix(contentType, "text/plain")) {
+		contentType = claimed
+	}
+	contentType, _, _ = mime.ParseMediaType(contentType)
+
+	filename = strings.Map(func(r rune) rune {
+		if r == ';' || r == ',' || r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(filename))
+	if filename == "" || filename == "." || filename == "content" {
+		filename = "attachment"
+	}
+	if path.Ext(filename) == "" {
+		if extensions, err := mime.ExtensionsByType(contentType); err == nil && len(extensions) > 0 {
+			filename += extensions[0]
+		} else if extension, ok := audioExtensions[contentType]; ok {
+			filename += extension
+		}
+	}
+
+	return &OutgoingAttachment{Filename: filename, ContentType: contentType, Data: data}
+}
+
+var dataURIRegex = regexp.MustCompile(`(data:[^;,"]*(;[^;,"]*)*;base64,)[A-Za-z0-9+/=]+`)
+
+// Shortens the base64 payload of every data URI in a log message.
+func redactDataURIs(text string) string {
+	return dataURIRegex.ReplaceAllString(text, "$1...")
+}
+
+// Data URIs can be megabytes long, so keep them out of the logs.
+func truncateForLog(text string) string {
+	if len(text) > 100 {
+		return text[:100] + "..."
+	}
+	return text
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Creates a new Open WebUI chat and makes it the one messages go to.
+func (s *Session) startChat(title string) bool {
+	chatId := createNewChat(s, title)
+	if chatId == "" {
+		return false
+	}
+	s.Chats = append(s.Chats, ChatRef{ID: chatId, Title: title, CreatedAt: time.Now()})
+	s.ChatID = chatId
+	s.ContextStart = ""
+	s.morePages = nil
+	s.save()
+	return true
+}
+
+func (s *Session) chat(id string) *ChatRef {
+	for index := range s.Chats {
+		if s.Chats[index].ID == id {
+			return &s.Chats[index]
+		}
+	}
+	return nil
+}
+
+// Finds a chat by its number in !chats or by title, preferring an exact
+// title over one that only starts with the query.
+func (s *Session) findChat(query string) *ChatRef {
+	if number, err := strconv.Atoi(query); err == nil {
+		if number >= 1 && number <= len(s.Chats) {
+			return &s.Chats[number-1]
+		}
+		return nil
+	}
+	for index := range s.Chats {
+		if strings.EqualFold(s.Chats[index].Title, query) {
+			return &s.Chats[index]
+		}
+	}
+	for index := range s.Chats {
+		if strings.HasPrefix(strings.ToLower(s.Chats[index].Title), strings.ToLower(query)) {
+			return &s.Chats[index]
+		}
+	}
+	return nil
+}
+
+func (s *Session) switchChat(chat *ChatRef) {
+	s.ChatID = chat.ID
+	// The trimmed context belonged to the previous chat.
+	s.ContextStart = ""
+	s.morePages = nil
+	s.save()
+}
+
+func handleNewCommand(ctx *CommandContext, args []string) string {
+	title := args[0]
+	if title == "" {
+		title = "Chat with " + ctx.ChatTitle
+	}
+	if !ctx.Session.startChat(title) {
+		return "Failed to create a new chat, check server logs for details."
+	}
+	return "Started a new chat, " + title + "."
+}
+
+func handleChatsCommand(ctx *CommandContext, args []string) string {
+	session := ctx.Session
+	all := args[0] != ""
+
+	lines := []string{}
+	archived := 0
+	for index, chat := range session.Chats {
+		if chat.Archived && !all {
+			archived++
+			continue
+		}
+		line := fmt.Sprintf("%d. %s", index+1, chat.Title)
+		if chat.ID == session.ChatID {
+			line += " (current)"
+		}
+		if chat.Archived {
+			line += " (archived)"
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "You have no chats yet, send a message or !new [title] to start one.")
+	}
+	if archived > 0 {
+		lines = append(lines, fmt.Sprintf("%d archived, send !chats all to see them.", archived))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func handleSwitchCommand(ctx *CommandContext, args []string) string {
+	session := ctx.Session
+	chat := session.findChat(args[0])
+	if chat == nil {
+		return "No chat matches " + args[0] + ". Send !chats to list your chats."
+	}
+	if chat.ID == session.ChatID {
+		return "Already in " + chat.Title + "."
+	}
+	if chat.Archived {
+		if err := toggleOpenWebUIChatArchive(chat.ID); err != nil {
+			log.Println("Failed to unarchive chat:", err)
+			return "Failed to unarchive " + chat.Title + ", check server logs for details."
+		}
+		chat.Archived = false
+	}
+	session.switchChat(chat)
+	return "Switched to " + chat.Title + "."
+}
+
+func handleRenameCommand(ctx *CommandContext, args []string) string {
+	session := ctx.Session
+	chat := session.chat(session.ChatID)
+	if chat == nil {
+		return "There is no current chat to rename, send a message or !new [title] to start one."
+	}
+	if err := renameOpenWebUIChat(chat.ID, args[0]); err != nil {
+		log.Println("Failed to rename chat:", err)
+		return "Failed to rename the chat, check server logs for details."
+	}
+	chat.Title = args[0]
+	session.save()
+	return "Renamed the current chat to " + chat.Title + "."
+}
+
+// Archives a chat in Open WebUI and hides it from !chats. Archiving the
+// current chat means the next message starts a new one.
+func handleArchiveCommand(ctx *CommandContext, args []string) string {
+	session := ctx.Session
+	chat := session.chat(session.ChatID)
+	if args[0] != "" {
+		chat = session.findChat(args[0])
+	}
+	if chat == nil {
+		return "No chat to archive. Send !chats to list your chats."
+	}
+	if chat.Archived {
+		return chat.Title + " is already archived."
+	}
+	if err := toggleOpenWebUIChatArchive(chat.ID); err != nil {
+		log.Println("Failed to archive chat:", err)
+		return "Failed to archive " + chat.Title + ", check server logs for details."
+	}
+	chat.Archived = true
+
+	if chat.ID != session.ChatID {
+		session.save()
+		return "Archived " + chat.Title + "."
+	}
+	session.ChatID = ""
+	session.ContextStart = ""
+	session.morePages = nil
+	session.save()
+	return "Archived " + chat.Title + ". Your next message will start a new chat, or send !switch to go back to another one."
+}
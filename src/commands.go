@@ -1,177 +1,420 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
+	"strconv"
 	"strings"
 )
 
-type ModelsResponse struct {
-	Models []Model `json:"models"`
+func registerCommands(registry *CommandRegistry) {
+	registry.register(&Command{
+		Name:        "model",
+		Aliases:     []string{"m"},
+		Description: "Show the model used for your chat.",
+		Run:         handleModelCommand,
+		Subcommands: []*Command{
+			{
+				Name:        "list",
+				Aliases:     []string{"ls"},
+				Description: "List all available models.",
+				Run:         handleModelListCommand,
+			},
+			{
+				Name:        "load",
+				Description: "Change the model used for your chat, by its number in the list or its name.",
+				Args:        []Argument{{Name: "model", Required: true, Rest: true}},
+				Run:         handleModelChangeCommand,
+				Admin:       true,
+			},
+			{
+				Name:        "info",
+				Description: "Show details of your model, or of another one by number or name.",
+				Args:        []Argument{{Name: "model", Rest: true}},
+				Run:         handleModelInfoCommand,
+			},
+		},
+	})
+	registry.register(&Command{
+		Name:        "websearch",
+		Aliases:     []string{"w", "web"},
+		Description: "Turn web search on or off, or toggle it if no state is given.",
+		Args: []Argument{{
+			Name:    "state",
+			Choices: []string{"on", "off", "true", "false", "1", "0"},
+		}},
+		Run: handleWebSearchCommand,
+	})
+	registry.register(&Command{
+		Name:        "prompt",
+		Aliases:     []string{"p"},
+		Description: "Show your system prompt, the instructions sent with every message.",
+		Run:         handlePromptCommand,
+		Subcommands: []*Command{
+			{
+				Name:        "show",
+				Description: "Show your system prompt.",
+				Run:         handlePromptShowCommand,
+			},
+			{
+				Name:        "set",
+				Description: "Set your system prompt.",
+				Args:        []Argument{{Name: "instructions", Required: true, Rest: true}},
+				Run:         handlePromptSetCommand,
+			},
+			{
+				Name:        "clear",
+				Description: "Remove your system prompt.",
+				Run:         handlePromptClearCommand,
+			},
+		},
+	})
+	registry.register(&Command{
+		Name:        "persona",
+		Description: "Switch to a persona, a preset prompt and model, or show the current one.",
+		Args:        []Argument{{Name: "name"}},
+		Run:         handlePersonaCommand,
+		Subcommands: []*Command{
+			{
+				Name:        "list",
+				Aliases:     []string{"ls"},
+				Description: "List the personas you can switch to.",
+				Run:         handlePersonaListCommand,
+			},
+			{
+				Name:        "off",
+				Description: "Stop using a persona.",
+				Run:         handlePersonaOffCommand,
+			},
+			{
+				Name:        "reload",
+				Description: "Read the personas file again.",
+				Run:         handlePersonaReloadCommand,
+				Admin:       true,
+			},
+		},
+	})
+	registry.register(&Command{
+		Name:        "set",
+		Description: "Change a generation parameter, or reset it with default.",
+		Args: []Argument{
+			{Name: "parameter", Required: true, Choices: paramNames},
+			{Name: "value", Required: true, Rest: true},
+		},
+		Run: handleSetCommand,
+	})
+	registry.register(&Command{
+		Name:        "params",
+		Description: "Show the generation parameters sent with your messages.",
+		Run:         handleParamsCommand,
+		Subcommands: []*Command{
+			{
+				Name:        "reset",
+				Description: "Reset every parameter to the model's default.",
+				Run:         handleParamsResetCommand,
+			},
+		},
+	})
+	registry.register(&Command{
+		Name:        "voice",
+		Aliases:     []string{"v"},
+		Description: "Turn spoken replies on or off, or toggle them if no state is given.",
+		Args: []Argument{{
+			Name:    "state",
+			Choices: []string{"on", "off", "true", "false", "1", "0"},
+		}},
+		Run: handleVoiceCommand,
+	})
+	registry.register(&Command{
+		Name:        "context",
+		Aliases:     []string{"c"},
+		Description: "Show how much of the conversation is sent to the model with each message.",
+		Run:         handleContextCommand,
+		Subcommands: []*Command{
+			{
+				Name:        "trim",
+				Description: "Only keep the last few turns in context.",
+				Args:        []Argument{{Name: "turns", Validate: validateCount}},
+				Run:         handleContextTrimCommand,
+			},
+			{
+				Name:        "clear",
+				Description: "Stop sending earlier messages to the model.",
+				Run:         handleContextClearCommand,
+			},
+			{
+				Name:        "restore",
+				Description: "Send the whole conversation again, within the configured limits.",
+				Run:         handleContextRestoreCommand,
+			},
+		},
+	})
+	registry.register(&Command{
+		Name:        "more",
+		Description: "Send the next pages of a long reply.",
+		Run:         handleMoreCommand,
+	})
+	registry.register(&Command{
+		Name:        "reset",
+		Description: "Start a fresh conversation with a new Open WebUI chat.",
+		Run:         handleResetCommand,
+	})
+	registry.register(&Command{
+		Name:        "new",
+		Description: "Start a new chat and switch to it. Your other chats are kept.",
+		Args:        []Argument{{Name: "title", Rest: true}},
+		Run:         handleNewCommand,
+	})
+	registry.register(&Command{
+		Name:        "chats",
+		Description: "List your chats, including archived ones with all.",
+		Args:        []Argument{{Name: "all", Choices: []string{"all"}}},
+		Run:         handleChatsCommand,
+	})
+	registry.register(&Command{
+		Name:        "switch",
+		Aliases:     []string{"sw"},
+		Description: "Switch to another chat by its number in !chats or its title.",
+		Args:        []Argument{{Name: "chat", Required: true, Rest: true}},
+		Run:         handleSwitchCommand,
+	})
+	registry.register(&Command{
+		Name:        "rename",
+		Description: "Rename the current chat.",
+		Args:        []Argument{{Name: "title", Required: true, Rest: true}},
+		Run:         handleRenameCommand,
+	})
+	registry.register(&Command{
+		Name:        "archive",
+		Description: "Archive the current chat, or another one by number or title.",
+		Args:        []Argument{{Name: "chat", Rest: true}},
+		Run:         handleArchiveCommand,
+	})
+	registry.register(&Command{
+		Name:        "access",
+		Description: "List senders waiting for approval.",
+		Run:         handleAccessCommand,
+		Admin:       true,
+		Subcommands: []*Command{
+			{
+				Name:        "approve",
+				Description: "Let a sender use the bot.",
+				Args:        []Argument{{Name: "number or uuid", Required: true}},
+				Run:         handleAccessApproveCommand,
+			},
+			{
+				Name:        "deny",
+				Description: "Stop a sender from using the bot.",
+				Args:        []Argument{{Name: "number or uuid", Required: true}},
+				Run:         handleAccessDenyCommand,
+			},
+		},
+	})
+	registry.register(&Command{
+		Name:        "help",
+		Aliases:     []string{"h"},
+		Description: "List commands, or explain one.",
+		Args:        []Argument{{Name: "command", Rest: true}},
+		Run:         handleHelpCommand,
+	})
 }
 
-type Model struct {
-	Name           string       `json:"name"`
-	Model          string       `json:"model"`
-	ModifiedAt     string       `json:"modified_at"`
-	Size           int64        `json:"size"`
-	Digest         string       `json:"digest"`
-	Details        ModelDetails `json:"details"`
-	ConnectionType string       `json:"connection_type"`
-	URLs           []int        `json:"urls"`
+func validateCount(value string) error {
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return fmt.Errorf("%q isn't a number of turns.", value)
+	}
+	return nil
 }
 
-type ModelDetails struct {
-	ParentModel       string    `json:"parent_model"`
-	Format            string    `json:"format"`
-	Family            string    `json:"family"`
-	Families          *[]string `json:"families"`
-	ParameterSize     string    `json:"parameter_size"`
-	QuantizationLevel string    `json:"quantization_level"`
+func handleHelpCommand(ctx *CommandContext, args []string) string {
+	return ctx.Registry.help(strings.Fields(args[0]), ctx.Access.isAdmin(ctx.Sender))
 }
 
-func sendOllamaCommand(verb, command string, payload []byte) []byte {
-	apikey := os.Getenv("OPENWEBUI_API_KEY")
-	url := os.Getenv("OPENWEBUI_URL")
-
-	req, err := http.NewRequest(
-		verb,
-		"http://"+url+"/ollama/api/"+command,
-		bytes.NewBuffer(payload),
-	)
-
-	if err != nil {
-		log.Println("Failed to send Ollama request:", err)
+func handleAccessCommand(ctx *CommandContext, args []string) string {
+	pending := ctx.Access.pending()
+	if len(pending) == 0 {
+		return "Nobody is waiting for approval."
 	}
+	return "Waiting for approval:\n" + strings.Join(pending, "\n")
+}
 
-	req.Header.Set("Authorization", "Bearer "+apikey)
-	req.Header.Set("Content-Type", "application/json")
+func handleAccessApproveCommand(ctx *CommandContext, args []string) string {
+	id := args[0]
+	ctx.Access.setAccess(id, AccessApproved)
+	sendSignalMessage("You've been approved, go ahead and send me a message!", ctx.AccountNumber, id)
+	return id + " approved."
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("Error sending request:", err)
-	}
-	defer resp.Body.Close()
+func handleAccessDenyCommand(ctx *CommandContext, args []string) string {
+	id := args[0]
+	ctx.Access.setAccess(id, AccessDenied)
+	return id + " denied."
+}
 
-	fmt.Println("Response status:", resp.Status)
-	body, err := io.ReadAll(resp.Body)
+func handleWebSearchCommand(ctx *CommandContext, args []string) string {
+	session := ctx.Session
 
-	return body
+	switch strings.ToLower(args[0]) {
+	case "true", "1", "on":
+		session.WebSearch = true
+		session.save()
+		return "Web search enabled."
+	case "false", "0", "off":
+		session.WebSearch = false
+		session.save()
+		return "Web search disabled."
+	}
+	return toggleWebSearch(session)
 }
 
-func handleModelChangeCommand(model, senderNumber string) string {
-	modelsMap := make(map[string]string)
-	modelBytes, err := os.ReadFile("models.json")
-	if err != nil {
-		log.Println("Error opening file. ")
+func toggleWebSearch(session *Session) string {
+	if os.Getenv("DEBUG") == "1" {
+		fmt.Println("Current value of web search: ", session.WebSearch)
 	}
-	err = json.Unmarshal([]byte(modelBytes), &modelsMap)
-	modelsMap[senderNumber] = model
-	modelsJson, _ := json.Marshal(modelsMap)
-	err = os.WriteFile("models.json", modelsJson, 0660)
-	if err != nil {
-		log.Println("Failed to update models.json. Check integrity of existing file.")
-		log.Println("Then, check that this program has sufficient privileges to create files in the running directory.")
-		pwd, _ := os.Getwd()
-		log.Println("Current running directory: " + pwd)
-		log.Println(err)
+	session.WebSearch = !session.WebSearch
+	session.save()
+	if session.WebSearch {
+		return "Web search enabled."
 	}
+	return "Web search disabled."
+}
 
-	err = os.Setenv("OPENWEBUI_MODEL", model)
+func handleVoiceCommand(ctx *CommandContext, args []string) string {
+	session := ctx.Session
 
-	if err != nil {
-		fmt.Println("Error setting model variable: ", err)
-		return "Failed to set model, check server logs for details."
+	switch strings.ToLower(args[0]) {
+	case "true", "1", "on":
+		session.Voice = true
+	case "false", "0", "off":
+		session.Voice = false
+	default:
+		session.Voice = !session.Voice
+	}
+	if session.Voice && ctx.Synthesizer == nil {
+		session.Voice = false
+		return "Spoken replies aren't available on this server."
 	}
+	session.save()
 
-	return "Model set to " + model
+	if session.Voice {
+		return "Spoken replies enabled. Replies will also be sent as audio."
+	}
+	return "Spoken replies disabled."
 }
 
-func handleModelListCommand(command string) string {
-	body := sendOllamaCommand("GET", command, nil)
-	var response ModelsResponse
-	err := json.Unmarshal(body, &response)
-	if err != nil {
-		fmt.Println("Error unmarshalling JSON:", err)
+func handleMoreCommand(ctx *CommandContext, args []string) string {
+	session := ctx.Session
+	if len(session.morePages) == 0 {
+		return "There is nothing more to send."
 	}
+	sendReplyPages(session.nextPages(session.morePages), nil, ctx.Reply)
+	return ""
+}
 
-	var modelList []string
-	for _, model := range response.Models {
-		modelList = append(modelList, model.Name)
-	}
+func handleResetCommand(ctx *CommandContext, args []string) string {
+	ctx.Session.ChatID = ""
+	ctx.Session.ContextStart = ""
+	ctx.Session.morePages = nil
+	ctx.Session.save()
 
-	modelListString := strings.Join(modelList, "\n")
+	return "Conversation reset. Your next message will start a new chat."
+}
 
-	return modelListString
+// Loads the current branch of the session's chat and splits the part still
+// in context into turns.
+func loadContextTurns(session *Session) ([]HistoryMessage, [][]HistoryMessage, error) {
+	if session.ChatID == "" {
+		return nil, nil, nil
+	}
+	chat, err := getOpenWebUIChat(session.ChatID)
+	if err != nil {
+		return nil, nil, err
+	}
+	branch := historyBranch(chat.Chat.History)
+	return branch, historyTurns(branch, session.ContextStart), nil
 }
 
-func handleWebSearchCommand(command string) string {
-	commandElements := strings.Fields(command)
+func handleContextCommand(ctx *CommandContext, args []string) string {
+	branch, turns, err := loadContextTurns(ctx.Session)
+	if err != nil {
+		log.Println("Failed to load chat history:", err)
+		return "Failed to load the conversation, check server logs for details."
+	}
+	return describeContext(turns, historyTurns(branch, ""), contextWindowFromEnv())
+}
 
-	if len(commandElements) == 0 {
-		return toggleWebSearch()
+func handleContextTrimCommand(ctx *CommandContext, args []string) string {
+	session := ctx.Session
+	branch, turns, err := loadContextTurns(session)
+	if err != nil {
+		log.Println("Failed to load chat history:", err)
+		return "Failed to load the conversation, check server logs for details."
 	}
 
-	switch commandElements[0] {
-	case "true":
-		fallthrough
-	case "1":
-		fallthrough
-	case "on":
-		os.Setenv("OPENWEBUI_WEB_SEARCH", "1")
-		return "Web search enabled."
-	case "false":
-		fallthrough
-	case "0":
-		fallthrough
-	case "off":
-		os.Setenv("OPENWEBUI_WEB_SEARCH", "1")
-		return "Web search enabled."
-	default:
-		return toggleWebSearch()
+	keep := 0
+	if args[0] != "" {
+		keep, _ = strconv.Atoi(args[0])
+	}
+	if keep >= len(turns) {
+		return fmt.Sprintf("Nothing to trim, the context only has %d turns.", len(turns))
 	}
+	if keep == 0 {
+		session.ContextStart = branch[len(branch)-1].ID
+	} else {
+		firstKept := turns[len(turns)-keep][0]
+		if firstKept.ParentID == nil {
+			session.ContextStart = ""
+		} else {
+			session.ContextStart = *firstKept.ParentID
+		}
+	}
+	session.save()
+	return fmt.Sprintf("Context trimmed to the last %d turns.", keep)
 }
 
-func toggleWebSearch() string {
-	currentState := os.Getenv("OPENWEBUI_WEB_SEARCH")
-	if os.Getenv("DEBUG") == "1" {
-		fmt.Println("Current value of web search: ", currentState)
+func handleContextClearCommand(ctx *CommandContext, args []string) string {
+	session := ctx.Session
+	branch, _, err := loadContextTurns(session)
+	if err != nil {
+		log.Println("Failed to load chat history:", err)
+		return "Failed to load the conversation, check server logs for details."
 	}
-	if currentState == "1" {
-		os.Setenv("OPENWEBUI_WEB_SEARCH", "0")
-		return "Web search disabled."
-	} else {
-		os.Setenv("OPENWEBUI_WEB_SEARCH", "1")
-		return "Web search enabled."
+	if len(branch) > 0 {
+		session.ContextStart = branch[len(branch)-1].ID
+		session.save()
 	}
+	return "Context cleared, the model will not see earlier messages."
 }
 
-func handleModelCommand(command, senderNumber string) string {
-	commandElements := strings.Fields(command)
+func handleContextRestoreCommand(ctx *CommandContext, args []string) string {
+	ctx.Session.ContextStart = ""
+	ctx.Session.save()
+	return "Context restored to the whole conversation."
+}
 
-	if len(commandElements) == 0 {
-		modelsMap := make(map[string]string)
-		modelBytes, err := os.ReadFile("models.json")
-		if err != nil {
-			log.Println("Error opening file. ")
+func describeContext(turns, allTurns [][]HistoryMessage, window ContextWindow) string {
+	sent := windowTurns(turns, window)
+	tokens := 0
+	var lines []string
+	for _, turn := range sent {
+		for _, message := range turn {
+			tokens += estimateTokens(message.Content)
 		}
-		err = json.Unmarshal([]byte(modelBytes), &modelsMap)
-
-		return "Your current model is " + modelsMap[senderNumber]
+		preview := []rune(strings.Join(strings.Fields(turn[0].Content), " "))
+		if len(preview) > 60 {
+			preview = append(preview[:60], '…')
+		}
+		lines = append(lines, "• "+string(preview))
 	}
 
-	switch commandElements[0] {
-	case "list":
-		return handleModelListCommand("tags")
-	case "load":
-		return handleModelChangeCommand(commandElements[1], senderNumber)
-	default:
-		return command + " not implemented at this time."
+	summary := fmt.Sprintf(
+		"Context: %d of %d turns (~%d tokens). Limit is %d turns or %d tokens.",
+		len(sent), len(allTurns), tokens, window.MaxTurns, window.MaxTokens,
+	)
+	if len(lines) == 0 {
+		return summary
 	}
+	return summary + "\n" + strings.Join(lines, "\n")
 }
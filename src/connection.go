@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	initialReconnectDelay = time.Second
+	maxReconnectDelay     = time.Minute
+	// Connections that stay up this long are considered healthy, so the next
+	// failure starts backing off from the initial delay again.
+	healthyConnectionTime = 30 * time.Second
+	// Enough to cover the backlog signal-cli delivers after a reconnect.
+	seenEnvelopeCapacity = 1000
+)
+
+// Keeps a connection to the Signal REST API WebSocket open forever, calling
+// handle for every frame received. Dropped connections are retried with
+// exponential backoff and jitter; signal-cli holds on to anything that arrives
+// while we are disconnected and delivers it once we reconnect.
+func receiveSignalMessages(apiURL string, handle func(message []byte)) {
+	delay := initialReconnectDelay
+	for {
+		log.Println("Connecting to Signal API at", apiURL)
+		conn, _, err := websocket.DefaultDialer.Dial(apiURL, nil)
+		if err != nil {
+			log.Println("Failed to connect:", err)
+		} else {
+			fmt.Println("Connected to Signal API. Waiting for messages...")
+			connectedAt := time.Now()
+			for {
+				_, message, err := conn.ReadMessage()
+				if err != nil {
+					log.Println("Read error, disconnected from Signal API:", err)
+					break
+				}
+				handle(message)
+			}
+			conn.Close()
+
+			if time.Since(connectedAt) > healthyConnectionTime {
+				delay = initialReconnectDelay
+			}
+		}
+
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Printf("Reconnecting to Signal API in %s", wait.Round(time.Millisecond))
+		time.Sleep(wait)
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// EnvelopeDeduper remembers recently seen envelopes so a message redelivered
+// around a reconnect isn't answered twice.
+type EnvelopeDeduper struct {
+	mu    sync.Mutex
+	seen  map[string]bool
+	order []string
+}
+
+func newEnvelopeDeduper() *EnvelopeDeduper {
+	return &EnvelopeDeduper{seen: make(map[string]bool)}
+}
+
+// Returns true the first time an envelope is seen, false afterwards.
+func (d *EnvelopeDeduper) firstSighting(envelope Envelope) bool {
+	source := envelope.SourceNumber
+	if source == "" {
+		source = envelope.SourceUuid
+	}
+	key := fmt.Sprintf("%s:%d", source, envelope.Timestamp)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.seen[key] {
+		return false
+	}
+	d.seen[key] = true
+	d.order = append(d.order, key)
+	if len(d.order) > seenEnvelopeCapacity {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Dispatcher runs jobs for different conversations in parallel while keeping
+// the jobs for any single conversation in the order they were dispatched.
+type Dispatcher struct {
+	mu      sync.Mutex
+	pending map[string][]func()
+}
+
+func newDispatcher() *Dispatcher {
+	return &Dispatcher{pending: make(map[string][]func())}
+}
+
+func (d *Dispatcher) dispatch(key string, job func()) {
+	d.mu.Lock()
+	queue, running := d.pending[key]
+	d.pending[key] = append(queue, job)
+	d.mu.Unlock()
+
+	if !running {
+		go d.run(key)
+	}
+}
+
+// Works through a conversation's queue, exiting once it is empty so idle
+// conversations don't hold a goroutine.
+func (d *Dispatcher) run(key string) {
+	for {
+		d.mu.Lock()
+		queue := d.pending[key]
+		if len(queue) == 0 {
+			delete(d.pending, key)
+			d.mu.Unlock()
+			return
+		}
+		job := queue[0]
+		d.pending[key] = queue[1:]
+		d.mu.Unlock()
+
+		job()
+	}
+}
+
+// CompletionLimiter caps how many completions are in flight against Open WebUI
+// at once, so a burst of users doesn't overload the machine running the model.
+type CompletionLimiter chan struct{}
+
+func newCompletionLimiter() CompletionLimiter {
+	limit := 1
+	if value := os.Getenv("OPENWEBUI_MAX_CONCURRENT"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			log.Println("Invalid OPENWEBUI_MAX_CONCURRENT, defaulting to 1:", value)
+		} else {
+			limit = parsed
+		}
+	}
+	return make(CompletionLimiter, limit)
+}
+
+func (l CompletionLimiter) acquire() {
+	l <- struct{}{}
+}
+
+func (l CompletionLimiter) release() {
+	<-l
+}
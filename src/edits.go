@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+)
+
+// How many recent questions per conversation can be edited or deleted.
+const maxTrackedQuestions = 200
+
+// QuestionRef ties a question someone sent to where it and its answer live
+// in Open WebUI, and to the Signal messages that hold the answer.
+type QuestionRef struct {
+	// Who asked, since only they may edit or delete the question.
+	Author     string
+	ChatID     string
+	QuestionID string
+	ReplyID    string
+	Timestamps []int64
+	// How often the first message of the answer has been edited, since
+	// Signal limits that.
+	Edits int
+}
+
+// Remembers the answer to the question sent at timestamp, which also
+// becomes the latest question in the conversation.
+func (s *Session) rememberQuestion(timestamp int64, ref QuestionRef) {
+	if ref.QuestionID == "" {
+		return
+	}
+	if s.questions == nil {
+		s.questions = make(map[int64]QuestionRef)
+	}
+	if _, exists := s.questions[timestamp]; !exists {
+		s.questionOrder = append(s.questionOrder, timestamp)
+	}
+	s.questions[timestamp] = ref
+	s.lastQuestion = timestamp
+	for len(s.questionOrder) > maxTrackedQuestions {
+		delete(s.questions, s.questionOrder[0])
+		s.questionOrder = s.questionOrder[1:]
+	}
+}
+
+// Returns the question sent at timestamp if it is the latest one, which is
+// the only one whose answer is regenerated when it's edited.
+func (s *Session) editableQuestion(sender Sender, timestamp int64) (*QuestionRef, bool) {
+	question, ok := s.questions[timestamp]
+	if !ok || question.Author != sender.id() || timestamp != s.lastQuestion || question.ChatID != s.ChatID || len(question.Timestamps) == 0 {
+		return nil, false
+	}
+	return &question, true
+}
+
+// Handles a question being deleted for everyone: the bot's answer is deleted
+// too, and the exchange is dropped from the Open WebUI chat so the model
+// doesn't see it again.
+func handleRemoteDelete(session *Session, sender Sender, timestamp int64, accountNumber string) {
+	question, ok := session.questions[timestamp]
+	if !ok || question.Author != sender.id() {
+		return
+	}
+	delete(session.questions, timestamp)
+
+	for _, replyTimestamp := range question.Timestamps {
+		if replyTimestamp != 0 {
+			deleteSignalMessage(replyTimestamp, accountNumber, session.Recipient)
+		}
+		delete(session.replies, replyTimestamp)
+	}
+
+	chat, err := getOpenWebUIChat(question.ChatID)
+	if err != nil {
+		log.Println("Failed to load chat to remove deleted question:", err)
+		return
+	}
+	history := chat.Chat.History
+	parentId := removeHistoryMessages(&history, question.ReplyID, question.QuestionID)
+	if question.ChatID == session.ChatID && (session.ContextStart == question.QuestionID || session.ContextStart == question.ReplyID) {
+		session.ContextStart = ""
+		if parentId != nil {
+			session.ContextStart = *parentId
+		}
+		session.save()
+	}
+	if err := updateOpenWebUIChat(question.ChatID, history); err != nil {
+		log.Println("Failed to remove deleted question from chat:", err)
+	}
+}
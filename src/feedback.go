@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+// How many recent replies per conversation can be rated with a reaction.
+const maxRatedReplies = 200
+
+// ReplyRef ties a message the bot sent to the reply it holds in Open WebUI.
+type ReplyRef struct {
+	ChatID    string
+	MessageID string
+	Model     string
+}
+
+type FeedbackData struct {
+	Rating  int    `json:"rating"`
+	ModelID string `json:"model_id"`
+	Reason  string `json:"reason"`
+	Comment string `json:"comment"`
+}
+
+type FeedbackMeta struct {
+	Arena     bool     `json:"arena"`
+	ChatID    string   `json:"chat_id"`
+	MessageID string   `json:"message_id"`
+	Tags      []string `json:"tags"`
+}
+
+type OpenWebUIFeedbackRequest struct {
+	Type string       `json:"type"`
+	Data FeedbackData `json:"data"`
+	Meta FeedbackMeta `json:"meta"`
+}
+
+type OpenWebUIFeedbackResponse struct {
+	ID string `json:"id"`
+}
+
+// Remembers which Open WebUI reply the messages with these timestamps hold,
+// so reactions to any of them rate that reply.
+func (s *Session) rememberReply(timestamps []int64, ref ReplyRef) {
+	if ref.MessageID == "" {
+		return
+	}
+	if s.replies == nil {
+		s.replies = make(map[int64]ReplyRef)
+	}
+	for _, timestamp := range timestamps {
+		if timestamp == 0 {
+			continue
+		}
+		s.replies[timestamp] = ref
+		s.replyOrder = append(s.replyOrder, timestamp)
+	}
+	for len(s.replyOrder) > maxRatedReplies {
+		delete(s.replies, s.replyOrder[0])
+		s.replyOrder = s.replyOrder[1:]
+	}
+}
+
+func reactionRating(emoji string) int {
+	switch emoji {
+	case "👍", "👍🏻", "👍🏼", "👍🏽", "👍🏾", "👍🏿":
+		return 1
+	case "👎", "👎🏻", "👎🏼", "👎🏽", "👎🏾", "👎🏿":
+		return -1
+	}
+	return 0
+}
+
+// Forwards a 👍 or 👎 on one of the bot's replies to Open WebUI as a rating,
+// and removes the rating again when the reaction is removed. Signal keeps one
+// reaction per person, so any other reaction replaces the rating too.
+func handleReaction(session *Session, reaction *Reaction, accountNumber string) {
+	if !isOwnAccount(reaction.TargetAuthorNumber, reaction.TargetAuthorUuid, accountNumber) {
+		return
+	}
+	ref, ok := session.replies[reaction.TargetSentTimestamp]
+	if !ok {
+		log.Println("Reaction to a reply that is no longer tracked, ignoring.")
+		return
+	}
+	rating := reactionRating(reaction.Emoji)
+	withdrawn := reaction.IsRemove || rating == 0
+
+	chat, err := getOpenWebUIChat(ref.ChatID)
+	if err != nil {
+		log.Println("Failed to load chat to rate reply:", err)
+		return
+	}
+	history := chat.Chat.History
+	message, ok := history.Messages[ref.MessageID]
+	if !ok {
+		log.Println("Rated reply", ref.MessageID, "is no longer in chat", ref.ChatID)
+		return
+	}
+
+	if withdrawn {
+		if message.FeedbackID == "" {
+			return
+		}
+		if err := deleteOpenWebUIFeedback(message.FeedbackID); err != nil {
+			log.Println("Failed to remove rating:", err)
+			return
+		}
+		message.FeedbackID = ""
+		delete(message.Annotation, "rating")
+	} else {
+		feedback := OpenWebUIFeedbackRequest{
+			Type: "rating",
+			Data: FeedbackData{Rating: rating, ModelID: ref.Model},
+			Meta: FeedbackMeta{ChatID: ref.ChatID, MessageID: ref.MessageID, Tags: []string{}},
+		}
+		feedbackId, err := postOpenWebUIFeedback(message.FeedbackID, feedback)
+		if err != nil {
+			log.Println("Failed to rate reply:", err)
+			return
+		}
+		message.FeedbackID = feedbackId
+		if message.Annotation == nil {
+			message.Annotation = map[string]any{}
+		}
+		message.Annotation["rating"] = rating
+	}
+
+	// Keep the thumbs in the web UI in step with the rating.
+	history.Messages[ref.MessageID] = message
+	if err := updateOpenWebUIChat(ref.ChatID, history); err != nil {
+		log.Println("Failed to save rating to chat:", err)
+	}
+}
+
+// Creates a rating, or updates it if feedbackId is set. Returns its ID.
+func postOpenWebUIFeedback(feedbackId string, feedback OpenWebUIFeedbackRequest) (string, error) {
+	apikey := os.Getenv("OPENWEBUI_API_KEY")
+	url := "http://" + os.Getenv("OPENWEBUI_URL") + "/api/v1/evaluations/feedback"
+	if feedbackId != "" {
+		url += "/" + feedbackId
+	}
+
+	feedbackBody, _ := json.Marshal(feedback)
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(feedbackBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+apikey)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	fmt.Println("Feedback response status:", resp.Status)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("Open WebUI returned " + resp.Status + ": " + string(body))
+	}
+	var response OpenWebUIFeedbackResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", err
+	}
+	return response.ID, nil
+}
+
+func deleteOpenWebUIFeedback(feedbackId string) error {
+	apikey := os.Getenv("OPENWEBUI_API_KEY")
+	url := os.Getenv("OPENWEBUI_URL")
+
+	req, err := http.NewRequest("DELETE", "http://"+url+"/api/v1/evaluations/feedback/"+feedbackId, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+apikey)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return errors.New("Open WebUI returned " + resp.Status + ": " + string(body))
+	}
+	return nil
+}
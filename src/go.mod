@@ -7,3 +7,7 @@ require github.com/gorilla/websocket v1.5.3
 require github.com/google/uuid v1.6.0
 
 require github.com/joho/godotenv v1.5.1
+
+require go.etcd.io/bbolt v1.4.3
+
+require golang.org/x/sys v0.29.0 // indirect
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Adds a message to the end of the current branch of the history, linking it
+// to its parent and making it the current message. Returns the new message ID.
+func appendHistoryMessage(history *History, message HistoryMessage) string {
+	if history.Messages == nil {
+		history.Messages = map[string]HistoryMessage{}
+	}
+
+	message.ID = uuid.New().String()
+	message.Timestamp = time.Now().Unix()
+	message.ChildrenIDs = []string{}
+	if history.CurrentID != nil {
+		if parent, ok := history.Messages[*history.CurrentID]; ok {
+			parentId := parent.ID
+			message.ParentID = &parentId
+			parent.ChildrenIDs = append(parent.ChildrenIDs, message.ID)
+			history.Messages[parent.ID] = parent
+		}
+	}
+
+	history.Messages[message.ID] = message
+	currentId := message.ID
+	history.CurrentID = &currentId
+
+	return message.ID
+}
+
+// Returns the messages from the root of the history to the current message.
+func historyBranch(history History) []HistoryMessage {
+	branch := []HistoryMessage{}
+	if history.CurrentID == nil {
+		return branch
+	}
+
+	seen := map[string]bool{}
+	id := *history.CurrentID
+	for {
+		message, ok := history.Messages[id]
+		if !ok || seen[id] {
+			break
+		}
+		seen[id] = true
+		branch = append(branch, message)
+		if message.ParentID == nil {
+			break
+		}
+		id = *message.ParentID
+	}
+	slices.Reverse(branch)
+
+	return branch
+}
+
+// Removes messages from the history, linking their children to their parent
+// so the rest of the conversation stays connected. Returns the ID of the
+// parent the removed messages hung from, or nil if they were at the root.
+func removeHistoryMessages(history *History, ids ...string) *string {
+	var parentId *string
+	for _, id := range ids {
+		message, ok := history.Messages[id]
+		if !ok {
+			continue
+		}
+		parentId = message.ParentID
+
+		if parentId != nil {
+			if parent, ok := history.Messages[*parentId]; ok {
+				index := slices.Index(parent.ChildrenIDs, id)
+				if index >= 0 {
+					parent.ChildrenIDs = slices.Replace(parent.ChildrenIDs, index, index+1, message.ChildrenIDs...)
+				}
+				history.Messages[parent.ID] = parent
+			}
+		}
+		for _, childId := range message.ChildrenIDs {
+			if child, ok := history.Messages[childId]; ok {
+				child.ParentID = parentId
+				history.Messages[childId] = child
+			}
+		}
+		delete(history.Messages, id)
+
+		if history.CurrentID != nil && *history.CurrentID == id {
+			history.CurrentID = parentId
+		}
+	}
+	return parentId
+}
+
+// ContextWindow limits how much of a conversation is sent to the model with
+// each completion, by number of turns and by an estimated token budget.
+type ContextWindow struct {
+	MaxTurns  int
+	MaxTokens int
+}
+
+func contextWindowFromEnv() ContextWindow {
+	return ContextWindow{
+		MaxTurns:  envInt("CONTEXT_MAX_TURNS", 20),
+		MaxTokens: envInt("CONTEXT_MAX_TOKENS", 4000),
+	}
+}
+
+// A rough estimate that is close enough for English text with most tokenizers.
+func estimateTokens(text string) int {
+	return len(text)/4 + 4
+}
+
+// Splits a branch into turns, each starting with a user message and followed
+// by the replies to it. Messages at or before contextStart have been trimmed
+// from the context and are left out.
+func historyTurns(branch []HistoryMessage, contextStart string) [][]HistoryMessage {
+	for index, message := range branch {
+		if message.ID == contextStart {
+			branch = branch[index+1:]
+			break
+		}
+	}
+
+	turns := [][]HistoryMessage{}
+	for _, message := range branch {
+		if message.Role == "user" || len(turns) == 0 {
+			turns = append(turns, []HistoryMessage{})
+		}
+		turns[len(turns)-1] = append(turns[len(turns)-1], message)
+	}
+	return turns
+}
+
+// Returns the most recent turns that fit in the window. The latest turn is
+// always included so the model at least sees the question being asked.
+func windowTurns(turns [][]HistoryMessage, window ContextWindow) [][]HistoryMessage {
+	tokens := 0
+	start := len(turns)
+	for start > 0 {
+		turnTokens := 0
+		for _, message := range turns[start-1] {
+			turnTokens += estimateTokens(message.Content)
+		}
+		fits := len(turns)-start < window.MaxTurns && tokens+turnTokens <= window.MaxTokens
+		if !fits && start < len(turns) {
+			break
+		}
+		tokens += turnTokens
+		start--
+	}
+	return turns[start:]
+}
+
+// Returns the part of the conversation to send to the model with the next
+// completion.
+func contextMessages(session *Session, history History) []OpenWebUIMessage {
+	turns := windowTurns(historyTurns(historyBranch(history), session.ContextStart), contextWindowFromEnv())
+	messages := []OpenWebUIMessage{}
+	for _, turn := range turns {
+		for _, message := range turn {
+			messages = append(messages, OpenWebUIMessage{
+				Role:    message.Role,
+				Content: message.Content,
+				Images:  historyImages(message),
+			})
+		}
+	}
+	return messages
+}
@@ -3,22 +3,101 @@ package main
 import (
 	"bufio"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"net/url"
 	"os"
 	"regexp"
+	"slices"
+	"strings"
 
-	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
 )
 
-func handleSignalMessage(message *DataMessage, accountNumber string, sender string) {
-	sendTypingIndicator("PUT", accountNumber, sender)
-	responseText := getOpenWebUIResponse(message.Message, message.Attachments)
-	sendTypingIndicator("DELETE", accountNumber, sender)
-	sendSignalMessage(responseText, accountNumber, sender)
+// Answers a message with the model's reply. If edited is set the message is
+// an edit of that earlier question, and its answer is regenerated in place.
+func handleSignalMessage(session *Session, textMessage string, message *DataMessage, edited *QuestionRef, target ReplyTarget, completions CompletionLimiter, transcriber Transcriber, synthesizer Synthesizer) {
+	sendSignalReaction("👀", target)
+	sendTypingIndicator("PUT", target.Account, session.Recipient)
+	textMessage, files, transcripts, err := transcribeVoiceNotes(transcriber, textMessage, message.Attachments)
+	if err != nil {
+		log.Println("Failed to transcribe voice note:", err)
+		sendTypingIndicator("DELETE", target.Account, session.Recipient)
+		sendSignalAttachments("Sorry, I couldn't transcribe that voice note. Please try again or send your message as text.", nil, target)
+		sendSignalReaction("❌", target)
+		return
+	}
+	if len(transcripts) > 0 && os.Getenv("SIGNAL_ECHO_TRANSCRIPTS") == "1" {
+		sendSignalAttachments("🎤 "+strings.Join(transcripts, "\n\n"), nil, target)
+	}
+	if textMessage == "" && len(files) == 0 {
+		// Empty messages are dropped before they get here, so only voice
+		// notes that transcribed to nothing are left.
+		sendTypingIndicator("DELETE", target.Account, session.Recipient)
+		if slices.ContainsFunc(message.Attachments, isVoiceNote) {
+			sendSignalAttachments("I couldn't hear anything in that voice note.", nil, target)
+			sendSignalReaction("❌", target)
+		}
+		return
+	}
+
+	// The typing indicator stays up while the streamed reply is still growing.
+	var reply *StreamingReply
+	var onUpdate func(text string)
+	if os.Getenv("SIGNAL_STREAM_RESPONSES") != "0" {
+		reply = newStreamingReply(target)
+		onUpdate = reply.update
+	}
+	replaceId := ""
+	if edited != nil {
+		replaceId = edited.QuestionID
+		if reply == nil {
+			reply = newStreamingReply(target)
+		}
+		reply.resume(edited.Timestamps[0], edited.Edits)
+	}
+	completions.acquire()
+	response := getOpenWebUIResponse(session, textMessage, files, replaceId, onUpdate)
+	completions.release()
+
+	responseText, attachments := replyAttachments(response)
+	pages := session.nextPages(paginate(responseText))
+	if file := replyFile(responseText); file != nil {
+		attachments = append(attachments, *file)
+	}
+	sendTypingIndicator("DELETE", target.Account, session.Recipient)
+	var timestamps []int64
+	edits := 0
+	if reply != nil {
+		timestamps = reply.finish(pages, attachments)
+		edits = reply.edits
+	} else {
+		timestamps = sendReplyPages(pages, attachments, target)
+	}
+	session.rememberReply(timestamps, ReplyRef{ChatID: session.ChatID, MessageID: response.MessageID, Model: session.completionModel()})
+	if edited != nil {
+		// The first page was edited in place, any others were sent anew.
+		for _, timestamp := range edited.Timestamps[1:] {
+			deleteSignalMessage(timestamp, target.Account, session.Recipient)
+		}
+	}
+	session.rememberQuestion(target.Quote.Timestamp, QuestionRef{
+		Author:     target.Quote.Author,
+		ChatID:     session.ChatID,
+		QuestionID: response.QuestionID,
+		ReplyID:    response.MessageID,
+		Timestamps: timestamps,
+		Edits:      edits,
+	})
+
+	if response.Failed {
+		sendSignalReaction("❌", target)
+		return
+	}
+	sendSignalReaction("✅", target)
+	if session.Voice && synthesizer != nil {
+		sendVoiceReply(synthesizer, responseText, target)
+	}
 }
 
 func main() {
@@ -29,7 +108,7 @@ func main() {
 		return
 	}
 
-	re := regexp.MustCompile(`^![a-z] *`)
+	re := regexp.MustCompile(`^![a-zA-Z]+`)
 
 	// Connect to Signal API WebSocket
 	// TODO: refactor for more than one account.
@@ -38,57 +117,95 @@ func main() {
 	signalNumber := os.Getenv("SIGNAL_NUMBER")
 	defaultModel := os.Getenv("OPENWEBUI_MODEL_DEFAULT")
 	// mise en place
-	accountsMap := make(map[string]string)
-	if _, err := os.Stat("accounts.json"); errors.Is(err, os.ErrNotExist) {
-		log.Println("Accounts.json does not exist, creating and skipping read.")
-		os.WriteFile("accounts.json", make([]byte, 0), 0660)
-	} else {
-		accountBytes, err := os.ReadFile("accounts.json")
-		if err != nil {
-			log.Println("Error opening file. ")
-		}
-		err = json.Unmarshal([]byte(accountBytes), &accountsMap)
-	}
-
-	modelsMap := make(map[string]string)
-	if _, err := os.Stat("models.json"); errors.Is(err, os.ErrNotExist) {
-		log.Println("Models.json does not exist, creating and skipping read.")
-		os.WriteFile("models.json", make([]byte, 0), 0660)
-	} else {
-		modelBytes, err := os.ReadFile("models.json")
-		if err != nil {
-			log.Println("Error opening file. ")
-		}
-		err = json.Unmarshal([]byte(modelBytes), &modelsMap)
-	}
-
-	apiURL := url.URL{Scheme: "ws", Host: signalUrl, Path: "/v1/receive/" + signalNumber}
-	conn, _, err := websocket.DefaultDialer.Dial(apiURL.String(), nil)
+	store, err := openStore()
 	if err != nil {
-		log.Fatal("Failed to connect: ", err)
+		log.Fatal("Failed to open store: ", err)
 	}
-	defer conn.Close()
-
-	fmt.Println("Connected to Signal API. Waiting for messages...")
-
-	// Read messages in a loop
-	for {
-		_, message, err := conn.ReadMessage()
-		if err != nil {
-			log.Println("Read error:", err)
-			break
-		}
+	defer store.Close()
+	sessions := newSessionManager(store, defaultModel, loadPersonas())
+	access := newAccessControl(sessions)
+	dispatcher := newDispatcher()
+	completions := newCompletionLimiter()
+	deduper := newEnvelopeDeduper()
+	commands := newCommandRegistry()
+	registerCommands(commands)
+	transcriber := newTranscriber()
+	synthesizer := newSynthesizer()
 
+	apiURL := url.URL{Scheme: "ws", Host: signalUrl, Path: "/v1/receive/" + signalNumber}
+	receiveSignalMessages(apiURL.String(), func(message []byte) {
 		var signalMessage SignalMessage
 		if err := json.Unmarshal(message, &signalMessage); err != nil {
 			log.Println("JSON parse error:", err)
-			continue
+			return
+		}
+
+		if !deduper.firstSighting(signalMessage.Envelope) {
+			if debug == "1" {
+				fmt.Println("Already handled this envelope, skipping.")
+			}
+			return
+		}
+
+		// An edit carries the whole new message, and is answered like one
+		// apart from replacing the earlier answer.
+		dataMessage := signalMessage.Envelope.activeDataMessage()
+		var editedTimestamp int64
+		if edit := signalMessage.Envelope.EditMessage; edit != nil && edit.DataMessage != nil {
+			editedTimestamp = edit.TargetSentTimestamp
 		}
 
 		// Extract and print just the message text
-		if signalMessage.Envelope.DataMessage != nil {
-			textMessage := signalMessage.Envelope.DataMessage.Message
-			senderNumber := signalMessage.Envelope.SourceNumber
+
+		if dataMessage != nil && dataMessage.Reaction != nil {
+			sender := envelopeSender(signalMessage.Envelope)
+			if !access.isAllowed(sender) {
+				log.Println("Ignoring reaction from", sender, "who is not allowed to use this bot.")
+				return
+			}
+			senderNumber := conversationRecipient(signalMessage.Envelope)
+			dispatcher.dispatch(senderNumber, func() {
+				handleReaction(sessions.get(senderNumber), dataMessage.Reaction, signalNumber)
+			})
+		} else if dataMessage != nil && dataMessage.RemoteDelete != nil {
+			sender := envelopeSender(signalMessage.Envelope)
+			if !access.isAllowed(sender) {
+				log.Println("Ignoring delete from", sender, "who is not allowed to use this bot.")
+				return
+			}
+			senderNumber := conversationRecipient(signalMessage.Envelope)
+			dispatcher.dispatch(senderNumber, func() {
+				handleRemoteDelete(sessions.get(senderNumber), sender, dataMessage.RemoteDelete.Timestamp, signalNumber)
+			})
+		} else if dataMessage != nil {
+			if !isAddressedToAccount(dataMessage, signalNumber) {
+				if debug == "1" {
+					fmt.Println("Group message not addressed to us, ignoring.")
+				}
+				return
+			}
+
+			textMessage := resolveMentions(dataMessage, signalNumber)
+			// Stickers, timer changes and profile key updates carry neither
+			// text nor attachments.
+			if strings.TrimSpace(textMessage) == "" && len(dataMessage.Attachments) == 0 {
+				if debug == "1" {
+					fmt.Println("Message has no text or attachments, ignoring.")
+				}
+				return
+			}
+
+			sender := envelopeSender(signalMessage.Envelope)
+			if !admitSender(access, sender, signalNumber) {
+				return
+			}
+
+			// For groups this is the group ID, so one chat is kept per group.
+			senderNumber := conversationRecipient(signalMessage.Envelope)
+			chatTitle := sender.id()
+			if dataMessage.GroupInfo != nil && dataMessage.GroupInfo.GroupName != "" {
+				chatTitle = dataMessage.GroupInfo.GroupName
+			}
 			if debug == "1" {
 				fmt.Println("Text:", textMessage)
 				fmt.Println("Message:", string(message))
@@ -98,66 +215,57 @@ func main() {
 			if debug == "1" {
 				fmt.Println("Regex Result:", match)
 			}
-
 			if match == "" {
-				if _, ok := accountsMap[signalMessage.Envelope.SourceNumber]; !ok {
-					if debug == "1" {
-						fmt.Println("New user, creating new chat.")
-					}
+				textMessage = withQuotedReply(dataMessage, textMessage, signalNumber)
+			}
+			target := newReplyTarget(signalNumber, senderNumber, sender, dataMessage)
+			if editedTimestamp != 0 {
+				target.Quote.Timestamp = editedTimestamp
+			}
 
-					os.Setenv("OPENWEBUI_MODEL", defaultModel)
-					newChatId := createNewChat(textMessage, signalNumber)
-					accountsMap[senderNumber] = newChatId
-					accountsJson, _ := json.Marshal(accountsMap)
-					err = os.WriteFile("accounts.json", accountsJson, 0660)
-					if err != nil {
-						log.Println("Failed to create updated accounts.json. Check integrity of existing file.")
-						log.Println("Then, check that this program has sufficient privileges to create files in the running directory.")
-						pwd, _ := os.Getwd()
-						log.Println("Current running directory: " + pwd)
-						log.Println(err)
+			// Messages from different conversations are handled in parallel,
+			// but each conversation's messages are handled in order.
+			dispatcher.dispatch(senderNumber, func() {
+				session := sessions.get(senderNumber)
+				if editedTimestamp != 0 {
+					question, ok := session.editableQuestion(sender, editedTimestamp)
+					if !ok || match != "" {
+						log.Println("Ignoring edit of a message that isn't the latest question from", sender)
+						return
 					}
+					handleSignalMessage(session, textMessage, dataMessage, question, target, completions, transcriber, synthesizer)
+				} else if match == "" {
+					if session.ChatID == "" {
+						if debug == "1" {
+							fmt.Println("New user, creating new chat.")
+						}
 
-					modelsMap[senderNumber] = defaultModel
-					modelsJson, _ := json.Marshal(modelsMap)
-					err = os.WriteFile("models.json", modelsJson, 0660)
-					if err != nil {
-						log.Println("Failed to update models.json. Check integrity of existing file.")
-						log.Println("Then, check that this program has sufficient privileges to create files in the running directory.")
-						pwd, _ := os.Getwd()
-						log.Println("Current running directory: " + pwd)
-						log.Println(err)
+						if !session.startChat("Chat with " + chatTitle) {
+							sendSignalAttachments("Sorry, I couldn't start a chat in Open WebUI. Please try again later.", nil, target)
+							return
+						}
 					}
+					handleSignalMessage(session, textMessage, dataMessage, nil, target, completions, transcriber, synthesizer)
 				} else {
-					os.Setenv("OPENWEBUI_CHAT_ID", accountsMap[senderNumber])
-					modelBytes, err := os.ReadFile("models.json")
-					if err != nil {
-						log.Println("Error opening file. ")
+					sendTypingIndicator("PUT", signalNumber, senderNumber)
+					ctx := &CommandContext{
+						Session:       session,
+						Sender:        sender,
+						AccountNumber: signalNumber,
+						Reply:         target,
+						ChatTitle:     chatTitle,
+						Access:        access,
+						Registry:      commands,
+						Synthesizer:   synthesizer,
 					}
-					err = json.Unmarshal([]byte(modelBytes), &modelsMap)
-					currentModel := modelsMap[senderNumber]
-					if currentModel == "" {
-						currentModel = defaultModel
-						modelsMap[senderNumber] = defaultModel
-						modelsJson, _ := json.Marshal(modelsMap)
-						err = os.WriteFile("models.json", modelsJson, 0660)
-						if err != nil {
-							log.Println("Failed to update models.json. Check integrity of existing file.")
-							log.Println("Then, check that this program has sufficient privileges to create files in the running directory.")
-							pwd, _ := os.Getwd()
-							log.Println("Current running directory: " + pwd)
-							log.Println(err)
-						}
+					responseText := commands.execute(ctx, textMessage)
+					sendTypingIndicator("DELETE", signalNumber, senderNumber)
+					// Commands that send their own messages reply with nothing.
+					if responseText != "" {
+						sendSignalAttachments(responseText, nil, target)
 					}
-					os.Setenv("OPENWEBUI_MODEL", modelsMap[senderNumber])
 				}
-				handleSignalMessage(signalMessage.Envelope.DataMessage, signalNumber, senderNumber)
-			} else {
-				sendTypingIndicator("PUT", signalNumber, senderNumber)
-				responseText := parseCommand(textMessage, senderNumber)
-				sendTypingIndicator("DELETE", signalNumber, senderNumber)
-				sendSignalMessage(responseText, signalNumber, senderNumber)
-			}
+			})
 		}
 
 		// Optionally write the entire received message to stdout for debugging
@@ -165,22 +273,5 @@ func main() {
 			fmt.Fprintln(os.Stdout, string(message))
 			bufio.NewWriter(os.Stdout).Flush()
 		}
-	}
-}
-
-func parseCommand(textMessage, senderNumber string) string {
-	commandVerb := textMessage[1]
-
-	commandRegex := regexp.MustCompile(`\s(.*)`)
-	command := commandRegex.FindString(textMessage)
-
-	switch commandVerb {
-	case 'm':
-		return handleModelCommand(command, senderNumber)
-	case 'w':
-		return handleWebSearchCommand(command)
-	default:
-		return "Unknown command, nothing done."
-	}
-
+	})
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Signal's styled text mode understands a small markdown-like syntax of its
+// own: **bold**, *italic*, ~strikethrough~, ||spoiler|| and `monospace`.
+// There is no way to escape these, and nothing for headings, lists or
+// tables, so replies are rewritten into what Signal can show.
+
+var (
+	fenceRegex          = regexp.MustCompile("^\\s*(```|~~~)")
+	headingRegex        = regexp.MustCompile(`^\s{0,3}#{1,6}\s+(.*?)\s*#*\s*$`)
+	ruleRegex           = regexp.MustCompile(`^\s{0,3}([-*_])(\s*([-*_])){2,}\s*$`)
+	quoteRegex          = regexp.MustCompile(`^\s{0,3}>\s?(.*)$`)
+	bulletRegex         = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	numberedRegex       = regexp.MustCompile(`^(\s*)(\d+)[.)]\s+(.*)$`)
+	tableSeparatorRegex = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+
+	codeSpanRegex      = regexp.MustCompile("`[^`\n]+`")
+	imageRegex         = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)(?:\s+"[^"]*")?\)`)
+	linkRegex          = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)(?:\s+"[^"]*")?\)`)
+	autolinkRegex      = regexp.MustCompile(`<((?:https?|mailto):[^>\s]+)>`)
+	underscoreBold     = regexp.MustCompile(`(^|[^\w])__([^_\s](?:[^_]*[^_\s])?)__([^\w]|$)`)
+	underscoreItalic   = regexp.MustCompile(`(^|[^\w])_([^_\s](?:[^_]*[^_\s])?)_([^\w]|$)`)
+	strikethroughRegex = regexp.MustCompile(`~~([^~\s](?:[^~]*[^~\s])?)~~`)
+	escapeRegex        = regexp.MustCompile("\\\\([\\\\`*_{}\\[\\]()#+\\-.!|~>])")
+)
+
+// Whether replies are converted to styled text. Set SIGNAL_FORMAT_REPLIES=0
+// to send the model's markdown as it is.
+func formatReplies() bool {
+	return os.Getenv("SIGNAL_FORMAT_REPLIES") != "0"
+}
+
+// Returns the text to send for a reply and the text mode to send it with.
+func styleReply(markdown string) (string, string) {
+	if !formatReplies() || hasBacktickCode(markdown) {
+		return markdown, ""
+	}
+	return markdownToStyled(markdown), "styled"
+}
+
+// Whether the markdown has code containing backticks. Styled text can't show
+// a backtick inside monospace, so such replies are sent as they are rather
+// than changing code people may copy.
+func hasBacktickCode(markdown string) bool {
+	fence := ""
+	for _, line := range strings.Split(markdown, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case fence != "" && strings.HasPrefix(trimmed, fence):
+			fence = ""
+		case fence != "" && strings.Contains(line, "`"):
+			return true
+		case fence == "" && fenceRegex.MatchString(line):
+			fence = fenceRegex.FindStringSubmatch(line)[1]
+		case fence == "" && strings.Contains(line, "``"):
+			// A code span wrapped in double backticks, which are used to
+			// hold single ones.
+			return true
+		}
+	}
+	return false
+}
+
+// Converts CommonMark to Signal's styled text. Headings become bold lines,
+// lists get bullets, table rows are joined with "|" and code blocks are shown
+// in monospace. Anything unrecognised is passed through unchanged, which
+// keeps half finished markdown in a streamed reply readable.
+func markdownToStyled(markdown string) string {
+	lines := strings.Split(strings.ReplaceAll(markdown, "\r\n", "\n"), "\n")
+	out := []string{}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		if match := fenceRegex.FindStringSubmatch(line); match != nil {
+			fence := match[1]
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				out = append(out, monospace(lines[i]))
+			}
+			continue
+		}
+
+		if isTableRow(line) && i+1 < len(lines) && tableSeparatorRegex.MatchString(lines[i+1]) {
+			header := []string{}
+			for _, cell := range tableCells(line) {
+				header = append(header, "**"+styleInline(cell)+"**")
+			}
+			out = append(out, strings.Join(header, " | "))
+			for i += 2; i < len(lines) && isTableRow(lines[i]); i++ {
+				row := []string{}
+				for _, cell := range tableCells(lines[i]) {
+					row = append(row, styleInline(cell))
+				}
+				out = append(out, strings.Join(row, " | "))
+			}
+			i--
+			continue
+		}
+
+		switch {
+		case headingRegex.MatchString(line):
+			out = append(out, "**"+styleInline(headingRegex.FindStringSubmatch(line)[1])+"**")
+		case ruleRegex.MatchString(line):
+			out = append(out, "──────────")
+		case quoteRegex.MatchString(line):
+			out = append(out, "▍"+styleInline(quoteRegex.FindStringSubmatch(line)[1]))
+		case bulletRegex.MatchString(line):
+			match := bulletRegex.FindStringSubmatch(line)
+			out = append(out, listIndent(match[1])+"• "+styleInline(taskBox(match[2])))
+		case numberedRegex.MatchString(line):
+			match := numberedRegex.FindStringSubmatch(line)
+			out = append(out, listIndent(match[1])+match[2]+". "+styleInline(match[3]))
+		default:
+			out = append(out, styleInline(line))
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+// Signal has no block styles, so code blocks are monospaced line by line.
+// Blocks containing backticks never get here, see hasBacktickCode.
+func monospace(line string) string {
+	if strings.TrimSpace(line) == "" {
+		return ""
+	}
+	return "`" + line + "`"
+}
+
+func isTableRow(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return strings.Count(trimmed, "|") > 0 && (strings.HasPrefix(trimmed, "|") || strings.HasSuffix(trimmed, "|") || strings.Count(trimmed, "|") > 1)
+}
+
+func tableCells(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimSuffix(strings.TrimPrefix(line, "|"), "|")
+	cells := []string{}
+	for _, cell := range strings.Split(line, "|") {
+		cells = append(cells, strings.TrimSpace(cell))
+	}
+	return cells
+}
+
+// Nested lists are indented by two spaces per level, however deep the
+// markdown indented them.
+func listIndent(indent string) string {
+	width := len(strings.ReplaceAll(indent, "\t", "    "))
+	return strings.Repeat("  ", width/2)
+}
+
+func taskBox(item string) string {
+	switch {
+	case strings.HasPrefix(item, "[ ] "):
+		return "☐ " + item[4:]
+	case strings.HasPrefix(item, "[x] "), strings.HasPrefix(item, "[X] "):
+		return "☑ " + item[4:]
+	}
+	return item
+}
+
+// Converts inline markdown, leaving code spans as they are since Signal
+// shows them in monospace just the same.
+func styleInline(text string) string {
+	var builder strings.Builder
+	last := 0
+	for _, span := range codeSpanRegex.FindAllStringIndex(text, -1) {
+		builder.WriteString(styleInlineText(text[last:span[0]]))
+		builder.WriteString(text[span[0]:span[1]])
+		last = span[1]
+	}
+	builder.WriteString(styleInlineText(text[last:]))
+	return builder.String()
+}
+
+func styleInlineText(text string) string {
+	// Escaped characters are set aside first so that nothing below treats
+	// them as markdown.
+	text = escapeRegex.ReplaceAllStringFunc(text, func(escape string) string {
+		return string(escapeBase + rune(escape[1]))
+	})
+	text = imageRegex.ReplaceAllStringFunc(text, func(image string) string {
+		match := imageRegex.FindStringSubmatch(image)
+		if match[1] == "" {
+			return match[2]
+		}
+		return match[1] + " (" + match[2] + ")"
+	})
+	text = linkRegex.ReplaceAllStringFunc(text, func(link string) string {
+		match := linkRegex.FindStringSubmatch(link)
+		if match[1] == match[2] || "mailto:"+match[1] == match[2] {
+			return match[1]
+		}
+		return match[1] + " (" + match[2] + ")"
+	})
+	text = autolinkRegex.ReplaceAllString(text, "$1")
+	text = underscoreBold.ReplaceAllString(text, "$1**$2**$3")
+	text = underscoreItalic.ReplaceAllString(text, "$1*$2*$3")
+	text = strikethroughRegex.ReplaceAllString(text, "~$1~")
+	return strings.Map(unescape, text)
+}
+
+// Escaped characters are held in the private use area while inline markdown
+// is converted.
+const escapeBase = '\uE000'
+
+// Signal can't escape its own style markers, so escaped ones are swapped for
+// lookalikes that it doesn't treat as formatting.
+var markerLookalikes = map[rune]rune{
+	'*': '∗',
+	'~': '∼',
+	'|': '∣',
+	'`': 'ˋ',
+}
+
+func unescape(r rune) rune {
+	if r < escapeBase || r >= escapeBase+128 {
+		return r
+	}
+	r -= escapeBase
+	if lookalike, ok := markerLookalikes[r]; ok {
+		return lookalike
+	}
+	return r
+}
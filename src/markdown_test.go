@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestMarkdownToStyled(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		styled   string
+	}{
+		{"heading", "# Title", "**Title**"},
+		{"closed heading", "### Sub heading ###", "**Sub heading**"},
+		{"bullets", "- one\n  - two\n* three", "• one\n  • two\n• three"},
+		{"numbered list", "1. first\n2) second", "1. first\n2. second"},
+		{"task list", "- [ ] todo\n- [x] done", "• ☐ todo\n• ☑ done"},
+		{"table", "| a | b |\n|---|:-:|\n| 1 | **2** |", "**a** | **b**\n1 | **2**"},
+		{"fence", "```go\nfmt.Println(\"hi\")\n\nx := 1\n```", "`fmt.Println(\"hi\")`\n\n`x := 1`"},
+		{"code span", "`code *not italic*` and __bold__", "`code *not italic*` and **bold**"},
+		{"inline code in text", "x := `a`", "x := `a`"},
+		{"escapes", `Use \*args\* and \_x\_`, "Use ∗args∗ and _x_"},
+		{"escaped link", `\[x\](y) \# heading`, "[x](y) # heading"},
+		{"quote", "> quoted _text_", "▍quoted *text*"},
+		{"rule", "---", "──────────"},
+		{"links", "[site](https://x.org) and <https://y.org>", "site (https://x.org) and https://y.org"},
+		{"image", "![alt](http://i/png)", "alt (http://i/png)"},
+		{"strikethrough", "~~gone~~", "~gone~"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if styled := markdownToStyled(test.markdown); styled != test.styled {
+				t.Errorf("got %q, want %q", styled, test.styled)
+			}
+		})
+	}
+}
+
+func TestStyleReplyKeepsBacktickCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		text     string
+		mode     string
+	}{
+		{"backticks in fence", "```go\nx := `a`\n```", "```go\nx := `a`\n```", ""},
+		{"double backtick span", "Use ``a`b`` here", "Use ``a`b`` here", ""},
+		{"plain code", "```\nplain\n```\n`span`", "`plain`\n`span`", "styled"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, mode := styleReply(test.markdown)
+			if text != test.text || mode != test.mode {
+				t.Errorf("got %q in mode %q, want %q in mode %q", text, mode, test.text, test.mode)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Most candidates listed when a model name is ambiguous.
+const maxModelSuggestions = 5
+
+// The name shown for a model, with its ID when the two differ.
+func (m OpenWebUIModel) label() string {
+	if m.Name == "" || m.Name == m.ID {
+		return m.ID
+	}
+	return m.Name + " (" + m.ID + ")"
+}
+
+// Lowercases and drops punctuation, so "Llama 3.1" matches "llama3.1:8b".
+func normaliseModelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
+
+// Finds models by their number in !model list, or by ID or name. Each
+// pass is looser than the last: an exact match, then the query's :latest tag
+// as Ollama would read it, then a match ignoring case and punctuation, then
+// a prefix, then anywhere in the name. The first pass
+// with any matches wins, so more than one result means the query was
+// ambiguous.
+func findModels(models []OpenWebUIModel, query string) []OpenWebUIModel {
+	if number, err := strconv.Atoi(query); err == nil {
+		if number >= 1 && number <= len(models) {
+			return []OpenWebUIModel{models[number-1]}
+		}
+		return nil
+	}
+
+	normalised := normaliseModelName(query)
+	passes := []func(name string) bool{
+		func(name string) bool { return name == query },
+		func(name string) bool { return !strings.Contains(query, ":") && name == query+":latest" },
+		func(name string) bool { return normalised != "" && normaliseModelName(name) == normalised },
+		func(name string) bool {
+			return normalised != "" && strings.HasPrefix(normaliseModelName(name), normalised)
+		},
+		func(name string) bool {
+			return normalised != "" && strings.Contains(normaliseModelName(name), normalised)
+		},
+	}
+	for _, matches := range passes {
+		found := []OpenWebUIModel{}
+		for _, model := range models {
+			if matches(model.ID) || matches(model.Name) {
+				found = append(found, model)
+			}
+		}
+		if len(found) > 0 {
+			return found
+		}
+	}
+	return nil
+}
+
+func handleModelCommand(ctx *CommandContext, args []string) string {
+	session := ctx.Session
+	if session.completionModel() != session.Model {
+		return "Your current model is " + session.completionModel() + ", set by the " + session.Persona + " persona. Without it you use " + session.Model
+	}
+	return "Your current model is " + session.Model
+}
+
+func handleModelListCommand(ctx *CommandContext, args []string) string {
+	models, err := getOpenWebUIModels()
+	if err != nil {
+		log.Println("Failed to list models:", err)
+		return "Failed to list models, check server logs for details."
+	}
+	if len(models) == 0 {
+		return "Open WebUI has no models available."
+	}
+
+	lines := []string{"Models:"}
+	for index, model := range models {
+		line := fmt.Sprintf("%d. %s", index+1, model.label())
+		if model.ID == ctx.Session.completionModel() {
+			line += " (current)"
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "Send !model load <number or name> to switch.")
+	return strings.Join(lines, "\n")
+}
+
+// Looks up the one model a query refers to. If there isn't exactly one, the
+// returned message explains why to the user.
+func resolveModel(models []OpenWebUIModel, query string) (*OpenWebUIModel, string) {
+	found := findModels(models, query)
+	switch {
+	case len(found) == 0:
+		return nil, "There is no model matching " + query + ". Send !model list to see the available models."
+	case len(found) > 1:
+		lines := []string{query + " matches several models:"}
+		for _, model := range found[:min(len(found), maxModelSuggestions)] {
+			lines = append(lines, model.label())
+		}
+		if len(found) > maxModelSuggestions {
+			lines = append(lines, fmt.Sprintf("and %d more.", len(found)-maxModelSuggestions))
+		}
+		lines = append(lines, "Be more specific, or use the model's number from !model list.")
+		return nil, strings.Join(lines, "\n")
+	}
+	return &found[0], ""
+}
+
+func handleModelChangeCommand(ctx *CommandContext, args []string) string {
+	models, err := getOpenWebUIModels()
+	if err != nil {
+		log.Println("Failed to list models:", err)
+		return "Failed to look up models, check server logs for details."
+	}
+
+	found, message := resolveModel(models, args[0])
+	if found == nil {
+		return message
+	}
+	model := found.ID
+	ctx.Session.Model = model
+	ctx.Session.save()
+
+	return "Model set to " + model
+}
+
+// Describes the current model, or the one named, in a short card.
+func handleModelInfoCommand(ctx *CommandContext, args []string) string {
+	models, err := getOpenWebUIModels()
+	if err != nil {
+		log.Println("Failed to list models:", err)
+		return "Failed to look up models, check server logs for details."
+	}
+
+	var model *OpenWebUIModel
+	if args[0] == "" {
+		current := ctx.Session.completionModel()
+		for index := range models {
+			if models[index].ID == current {
+				model = &models[index]
+			}
+		}
+		if model == nil {
+			return "Your model " + current + " isn't available in Open WebUI."
+		}
+	} else {
+		var message string
+		if model, message = resolveModel(models, args[0]); model == nil {
+			return message
+		}
+	}
+	return describeModel(model, models)
+}
+
+func describeModel(model *OpenWebUIModel, models []OpenWebUIModel) string {
+	lines := []string{model.label()}
+	if model.Info != nil && model.Info.Meta.Description != "" {
+		lines = append(lines, model.Info.Meta.Description)
+	}
+
+	// Workspace models only carry Ollama's details on the model they're
+	// built on.
+	ollama := model.Ollama
+	if ollama == nil && model.Info != nil && model.Info.BaseModelID != nil {
+		for _, base := range models {
+			if base.ID == *model.Info.BaseModelID {
+				ollama = base.Ollama
+				lines = append(lines, "Based on: "+base.label())
+			}
+		}
+	}
+
+	var show *OllamaShowResponse
+	if ollama != nil {
+		details := ollama.Details
+		lines = appendModelField(lines, "Family", details.Family)
+		lines = appendModelField(lines, "Parameters", details.ParameterSize)
+		lines = appendModelField(lines, "Quantization", details.QuantizationLevel)
+		if ollama.Size > 0 {
+			lines = append(lines, "Size on disk: "+formatDiskSize(ollama.Size))
+		}
+		var err error
+		if show, err = getOllamaModelInfo(ollama.Model); err != nil {
+			log.Println("Failed to get details of "+ollama.Model+":", err)
+		}
+	}
+
+	if contextLength := modelContextLength(model, show); contextLength > 0 {
+		lines = append(lines, fmt.Sprintf("Context length: %d tokens", contextLength))
+	}
+	if vision, known := modelCapability(model, show, "vision"); known {
+		lines = append(lines, "Vision: "+yesNo(vision))
+	}
+	if tools, known := modelCapability(model, show, "tools"); known {
+		lines = append(lines, "Tools: "+yesNo(tools))
+	}
+	lines = appendModelField(lines, "Served by", model.OwnedBy)
+	if ollama != nil {
+		if modified, err := time.Parse(time.RFC3339Nano, ollama.ModifiedAt); err == nil {
+			lines = append(lines, "Updated: "+modified.Format("2 Jan 2006"))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func appendModelField(lines []string, name string, value string) []string {
+	if value == "" {
+		return lines
+	}
+	return append(lines, name+": "+value)
+}
+
+func formatDiskSize(size int64) string {
+	if size >= 1e9 {
+		return fmt.Sprintf("%.1f GB", float64(size)/1e9)
+	}
+	return fmt.Sprintf("%.0f MB", float64(size)/1e6)
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+// The context window the model runs with: num_ctx if Open WebUI or the
+// Modelfile sets one, otherwise the most the model was trained for.
+func modelContextLength(model *OpenWebUIModel, show *OllamaShowResponse) int {
+	if model.Info != nil {
+		if numCtx, ok := model.Info.Params["num_ctx"].(float64); ok && numCtx > 0 {
+			return int(numCtx)
+		}
+	}
+	if show == nil {
+		return 0
+	}
+	for _, line := range strings.Split(show.Parameters, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "num_ctx" {
+			if numCtx, err := strconv.Atoi(fields[1]); err == nil {
+				return numCtx
+			}
+		}
+	}
+	for key, value := range show.ModelInfo {
+		if length, ok := value.(float64); ok && strings.HasSuffix(key, ".context_length") {
+			return int(length)
+		}
+	}
+	return 0
+}
+
+// Whether the model has a capability, and whether that is known at all.
+// Open WebUI's own setting wins over what Ollama reports, and tools attached
+// in Open WebUI count as tool support.
+func modelCapability(model *OpenWebUIModel, show *OllamaShowResponse, capability string) (bool, bool) {
+	if model.Info != nil {
+		if enabled, ok := model.Info.Meta.Capabilities[capability]; ok {
+			return enabled, true
+		}
+		if capability == "tools" && len(model.Info.Meta.ToolIDs) > 0 {
+			return true, true
+		}
+	}
+	if show != nil && show.Capabilities != nil {
+		return slices.Contains(show.Capabilities, capability), true
+	}
+	return false, false
+}
+
+// OllamaShowResponse is the part of Ollama's /api/show used for !model info.
+type OllamaShowResponse struct {
+	// The Modelfile's PARAMETER lines, one "name value" pair per line.
+	Parameters   string         `json:"parameters"`
+	ModelInfo    map[string]any `json:"model_info"`
+	Capabilities []string       `json:"capabilities"`
+}
+
+// Asks Ollama, through Open WebUI, for a model's full details.
+func getOllamaModelInfo(name string) (*OllamaShowResponse, error) {
+	apikey := os.Getenv("OPENWEBUI_API_KEY")
+	url := os.Getenv("OPENWEBUI_URL")
+
+	// Older Open WebUI versions expect the model under "name".
+	requestBody, _ := json.Marshal(map[string]string{"name": name, "model": name})
+	req, err := http.NewRequest("POST", "http://"+url+"/ollama/api/show", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apikey)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Open WebUI returned " + resp.Status + ": " + string(body))
+	}
+	var response OllamaShowResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,18 +12,19 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"time"
-
-	"github.com/google/uuid"
+	"strings"
 )
 
 type Data struct {
 	Status string `json:"status"`
 }
 
+// A file attached to a message. Uploaded files are referenced by ID, while
+// generated images are referenced by URL.
 type OpenWebUIFile struct {
 	Type string `json:"type"`
-	ID   string `json:"id"`
+	ID   string `json:"id,omitempty"`
+	URL  string `json:"url,omitempty"`
 }
 
 type OpenWebUIMessage struct {
@@ -30,18 +33,59 @@ type OpenWebUIMessage struct {
 	Content   string   `json:"content"`
 	Timestamp int64    `json:"timestamp,omitempty"`
 	Models    []string `json:"models,omitempty"`
+	// Data URIs of images sent to vision models alongside Content.
+	Images []string `json:"-"`
+}
+
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	URL string `json:"url"`
+}
+
+// Messages with images are sent with their content as a list of parts, the
+// way OpenAI compatible APIs expect. Everything else keeps plain text content.
+func (m OpenWebUIMessage) MarshalJSON() ([]byte, error) {
+	type plain OpenWebUIMessage
+	if len(m.Images) == 0 {
+		return json.Marshal(plain(m))
+	}
+
+	parts := []ContentPart{{Type: "text", Text: m.Content}}
+	for _, image := range m.Images {
+		parts = append(parts, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: image}})
+	}
+	return json.Marshal(struct {
+		plain
+		Content []ContentPart `json:"content"`
+	}{plain(m), parts})
 }
 
 type HistoryMessage struct {
-	ID        string   `json:"id"`
-	Role      string   `json:"role"`
-	Content   string   `json:"content"`
-	Timestamp int64    `json:"timestamp"`
-	Models    []string `json:"models"`
+	ID          string            `json:"id"`
+	ParentID    *string           `json:"parentId"`
+	ChildrenIDs []string          `json:"childrenIds"`
+	Role        string            `json:"role"`
+	Content     string            `json:"content"`
+	Timestamp   int64             `json:"timestamp"`
+	Models      []string          `json:"models,omitempty"`
+	Model       string            `json:"model,omitempty"`
+	Files       []OpenWebUIFile   `json:"files,omitempty"`
+	Sources     []OpenWebUISource `json:"sources,omitempty"`
+	Done        bool              `json:"done,omitempty"`
+	// Set by rating a reply, holds the rating as shown in the web UI.
+	Annotation map[string]any `json:"annotation,omitempty"`
+	FeedbackID string         `json:"feedbackId,omitempty"`
 }
 
+// Open WebUI stores a chat as a tree of messages linked by parent and child
+// IDs, with CurrentID pointing at the leaf of the branch being shown.
 type History struct {
-	CurrentID string                    `json:"current_id"`
+	CurrentID *string                   `json:"currentId"`
 	Messages  map[string]HistoryMessage `json:"messages"`
 }
 
@@ -56,6 +100,33 @@ type OpenWebUIChatCreateRequest struct {
 	Chat Chat `json:"chat"`
 }
 
+// Open WebUI merges the fields sent here into the stored chat, so anything
+// not listed (title, tags, params...) is left untouched.
+type ChatHistoryUpdate struct {
+	Messages []HistoryMessage `json:"messages"`
+	History  History          `json:"history"`
+}
+
+type OpenWebUIChatUpdateRequest struct {
+	Chat ChatHistoryUpdate `json:"chat"`
+}
+
+type ChatTitleUpdate struct {
+	Title string `json:"title"`
+}
+
+type OpenWebUIChatRenameRequest struct {
+	Chat ChatTitleUpdate `json:"chat"`
+}
+
+type OpenWebUIChatCompletedRequest struct {
+	Model     string             `json:"model"`
+	Messages  []OpenWebUIMessage `json:"messages"`
+	ChatID    string             `json:"chat_id"`
+	SessionID string             `json:"session_id"`
+	ID        string             `json:"id"`
+}
+
 type Meta map[string]interface{}
 
 type OpenWebUIChatRequest struct {
@@ -88,6 +159,7 @@ type OpenWebUICompletion struct {
 	SessionID       string             `json:"session_id"`
 	BackgroundTasks BackgroundTasks    `json:"background_tasks"`
 	Features        Features           `json:"features"`
+	GenerationParams
 }
 
 type OpenWebUIChatCreateResponse struct {
@@ -118,6 +190,26 @@ type OpenWebUICompletionResponse struct {
 		CompletionTokens int `json:"completion_tokens"`
 		TotalTokens      int `json:"total_tokens"`
 	} `json:"usage"`
+	Sources []OpenWebUISource `json:"sources,omitempty"`
+	Files   []OpenWebUIFile   `json:"files,omitempty"`
+}
+
+// Open WebUI sends the sources it retrieved (web search results, documents)
+// as an event of their own at the start of a stream.
+type OpenWebUICompletionChunk struct {
+	ID      string            `json:"id"`
+	Created int64             `json:"created"`
+	Model   string            `json:"model"`
+	Sources []OpenWebUISource `json:"sources,omitempty"`
+	Files   []OpenWebUIFile   `json:"files,omitempty"`
+	Choices []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
 }
 
 type OpenWebUIChatResponse struct {
@@ -140,6 +232,51 @@ type OpenWebUIChatResponse struct {
 	} `json:"usage"`
 }
 
+type OpenWebUIModelsResponse struct {
+	Data []OpenWebUIModel `json:"data"`
+}
+
+// A model as listed by /api/models. Info is only present for models that
+// have been configured in Open WebUI's workspace, and Ollama only for models
+// served by an Ollama connection.
+type OpenWebUIModel struct {
+	ID      string              `json:"id"`
+	Name    string              `json:"name"`
+	OwnedBy string              `json:"owned_by"`
+	Info    *OpenWebUIModelInfo `json:"info,omitempty"`
+	Ollama  *OllamaModel        `json:"ollama,omitempty"`
+}
+
+type OpenWebUIModelInfo struct {
+	// The model a workspace model is built on, if any.
+	BaseModelID *string        `json:"base_model_id"`
+	Params      map[string]any `json:"params"`
+	Meta        struct {
+		Description  string          `json:"description"`
+		Capabilities map[string]bool `json:"capabilities"`
+		ToolIDs      []string        `json:"toolIds"`
+	} `json:"meta"`
+}
+
+// OllamaModel is the entry Ollama's /api/tags returns for a model.
+type OllamaModel struct {
+	Name       string       `json:"name"`
+	Model      string       `json:"model"`
+	ModifiedAt string       `json:"modified_at"`
+	Size       int64        `json:"size"`
+	Digest     string       `json:"digest"`
+	Details    ModelDetails `json:"details"`
+}
+
+type ModelDetails struct {
+	ParentModel       string    `json:"parent_model"`
+	Format            string    `json:"format"`
+	Family            string    `json:"family"`
+	Families          *[]string `json:"families"`
+	ParameterSize     string    `json:"parameter_size"`
+	QuantizationLevel string    `json:"quantization_level"`
+}
+
 type OpenWebUIFileResponse struct {
 	ID            string  `json:"id"`
 	UserID        string  `json:"user_id"`
@@ -154,35 +291,21 @@ type OpenWebUIFileResponse struct {
 	AccessControl *string `json:"access_control,omitempty"`
 }
 
-func createNewChat(messageText, sender string) string {
+// Creates an empty Open WebUI chat. Messages are added to its history as the
+// conversation happens, see appendChatTurn.
+func createNewChat(session *Session, title string) string {
 	apikey := os.Getenv("OPENWEBUI_API_KEY")
 	url := os.Getenv("OPENWEBUI_URL")
-	model := os.Getenv("OPENWEBUI_MODEL")
-	newUuid := uuid.New()
-	currentTime := time.Now().Unix()
+	model := session.completionModel()
 
 	messageRequest := OpenWebUIChatCreateRequest{
 		Chat: Chat{
-			Title:  "Chat with " + sender,
-			Models: []string{model},
-			Messages: []OpenWebUIMessage{
-				{
-					ID:        newUuid.String(),
-					Role:      "user",
-					Timestamp: currentTime,
-					Models:    []string{model},
-					Content:   messageText}},
+			Title:    title,
+			Models:   []string{model},
+			Messages: []OpenWebUIMessage{},
 			History: History{
-				CurrentID: newUuid.String(),
-				Messages: map[string]HistoryMessage{
-					newUuid.String(): {
-						ID:        newUuid.String(),
-						Role:      "user",
-						Timestamp: currentTime,
-						Models:    []string{model},
-						Content:   messageText,
-					},
-				}},
+				Messages: map[string]HistoryMessage{},
+			},
 		},
 	}
 
@@ -194,7 +317,8 @@ func createNewChat(messageText, sender string) string {
 		bytes.NewBuffer(messageBody),
 	)
 	if err != nil {
-		log.Println("Failed to send typing start:", err)
+		log.Println("Failed to create chat:", err)
+		return ""
 	}
 
 	req.Header.Set("Authorization", "Bearer "+apikey)
@@ -203,12 +327,21 @@ func createNewChat(messageText, sender string) string {
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Println("Error sending request:", err)
+		log.Println("Failed to create chat:", err)
+		return ""
 	}
 	defer resp.Body.Close()
 
 	fmt.Println("Response status:", resp.Status)
 	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("Failed to create chat:", err)
+		return ""
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Println("Failed to create chat, Open WebUI returned " + resp.Status + ": " + string(body))
+		return ""
+	}
 	var response OpenWebUIChatCreateResponse
 	err = json.Unmarshal(body, &response)
 	if err != nil {
@@ -218,18 +351,7 @@ func createNewChat(messageText, sender string) string {
 	return response.ID
 }
 
-func sendToOpenWebUI(messageText string, fileIds []string) string {
-	chatid := os.Getenv("OPENWEBUI_CHAT_ID")
-	model := os.Getenv("OPENWEBUI_MODEL")
-	apikey := os.Getenv("OPENWEBUI_API_KEY")
-	url := os.Getenv("OPENWEBUI_URL")
-	messages := []OpenWebUIMessage{
-		{
-			Role:    "user",
-			Content: messageText,
-		},
-	}
-
+func openWebUIFiles(fileIds []string) []OpenWebUIFile {
 	files := []OpenWebUIFile{}
 	for _, element := range fileIds {
 		files = append(files,
@@ -238,6 +360,20 @@ func sendToOpenWebUI(messageText string, fileIds []string) string {
 				ID:   element,
 			})
 	}
+	return files
+}
+
+func newOpenWebUICompletion(session *Session, conversation []OpenWebUIMessage, fileIds []string) OpenWebUICompletion {
+	messages := []OpenWebUIMessage{}
+	if systemPrompt := session.systemPrompt(); systemPrompt != "" {
+		messages = append(messages, OpenWebUIMessage{
+			Role:    "system",
+			Content: systemPrompt,
+		})
+	}
+	messages = append(messages, conversation...)
+
+	files := openWebUIFiles(fileIds)
 
 	backgroundTasks := BackgroundTasks{
 		TitleGeneration:    false,
@@ -247,23 +383,29 @@ func sendToOpenWebUI(messageText string, fileIds []string) string {
 
 	features := Features{
 		CodeInterpreter: false,
-		WebSearch:       false,
+		WebSearch:       session.WebSearch,
 		ImageGeneration: false,
 		Memory:          false,
 	}
 
-	messageData := OpenWebUICompletion{
-		Model:           model,
-		ChatID:          chatid,
-		Stream:          false,
-		Messages:        messages,
-		Files:           files,
-		BackgroundTasks: backgroundTasks,
-		Features:        features,
+	return OpenWebUICompletion{
+		Model:            session.completionModel(),
+		ChatID:           session.ChatID,
+		Stream:           false,
+		Messages:         messages,
+		Files:            files,
+		BackgroundTasks:  backgroundTasks,
+		Features:         features,
+		GenerationParams: session.generationParams(),
 	}
+}
+
+func postOpenWebUICompletion(messageData OpenWebUICompletion) (*http.Response, error) {
+	apikey := os.Getenv("OPENWEBUI_API_KEY")
+	url := os.Getenv("OPENWEBUI_URL")
 
 	messageBody, _ := json.Marshal(messageData)
-	fmt.Println("Message Body:", string(messageBody))
+	fmt.Println("Message Body:", redactDataURIs(string(messageBody)))
 	req, err := http.NewRequest(
 		"POST",
 		"http://"+url+"/api/chat/completions",
@@ -271,7 +413,7 @@ func sendToOpenWebUI(messageText string, fileIds []string) string {
 	)
 
 	if err != nil {
-		log.Println("Failed to send typing start:", err)
+		return nil, err
 	}
 
 	req.Header.Set("Authorization", "Bearer "+apikey)
@@ -280,20 +422,269 @@ func sendToOpenWebUI(messageText string, fileIds []string) string {
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Println("Error sending request:", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
 	fmt.Println("Response status:", resp.Status)
+	return resp, nil
+}
+
+func sendToOpenWebUI(session *Session, messages []OpenWebUIMessage, fileIds []string) (*OpenWebUIReply, error) {
+	resp, err := postOpenWebUICompletion(newOpenWebUICompletion(session, messages, fileIds))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
 	body, err := io.ReadAll(resp.Body)
 	var response OpenWebUICompletionResponse
 	err = json.Unmarshal(body, &response)
 	if err != nil {
 		fmt.Println("Error unmarshalling JSON:", err)
 	}
+	if len(response.Choices) == 0 {
+		log.Println("Open WebUI returned no choices:", string(body))
+		return nil, errors.New("empty response from Open WebUI")
+	}
+
+	return &OpenWebUIReply{
+		Content: response.Choices[0].Message.Content,
+		Sources: response.Sources,
+		Files:   response.Files,
+	}, nil
+}
+
+// Requests a streamed completion, calling onUpdate with the full text
+// received so far every time a new chunk arrives. Returns the final text.
+func streamFromOpenWebUI(session *Session, messages []OpenWebUIMessage, fileIds []string, onUpdate func(text string)) (*OpenWebUIReply, error) {
+	messageData := newOpenWebUICompletion(session, messages, fileIds)
+	messageData.Stream = true
+	resp, err := postOpenWebUICompletion(messageData)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Println("Open WebUI completion failed:", string(body))
+		return nil, errors.New("Open WebUI returned " + resp.Status)
+	}
+
+	reply := &OpenWebUIReply{}
+	var builder strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk OpenWebUICompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			if os.Getenv("DEBUG") == "1" {
+				fmt.Println("Skipping unrecognised stream event:", data)
+			}
+			continue
+		}
+		reply.Sources = append(reply.Sources, chunk.Sources...)
+		reply.Files = append(reply.Files, chunk.Files...)
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		builder.WriteString(chunk.Choices[0].Delta.Content)
+		onUpdate(builder.String())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
 
-	responseMessage := response.Choices[0].Message.Content
-	return responseMessage
+	if builder.Len() == 0 {
+		return nil, errors.New("empty response from Open WebUI")
+	}
+	reply.Content = builder.String()
+	return reply, nil
+}
+
+func getOpenWebUIModels() ([]OpenWebUIModel, error) {
+	apikey := os.Getenv("OPENWEBUI_API_KEY")
+	url := os.Getenv("OPENWEBUI_URL")
+
+	req, err := http.NewRequest("GET", "http://"+url+"/api/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apikey)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Open WebUI returned " + resp.Status + ": " + string(body))
+	}
+	var response OpenWebUIModelsResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// Returns nil without an error if Open WebUI doesn't know the model.
+func getOpenWebUIModel(id string) (*OpenWebUIModel, error) {
+	models, err := getOpenWebUIModels()
+	if err != nil {
+		return nil, err
+	}
+	for _, model := range models {
+		if model.ID == id {
+			return &model, nil
+		}
+	}
+	return nil, nil
+}
+
+func getOpenWebUIChat(chatId string) (*OpenWebUIChatCreateResponse, error) {
+	apikey := os.Getenv("OPENWEBUI_API_KEY")
+	url := os.Getenv("OPENWEBUI_URL")
+
+	req, err := http.NewRequest("GET", "http://"+url+"/api/v1/chats/"+chatId, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apikey)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Open WebUI returned " + resp.Status + ": " + string(body))
+	}
+	var response OpenWebUIChatCreateResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+	if response.Chat.History.Messages == nil {
+		response.Chat.History.Messages = map[string]HistoryMessage{}
+	}
+
+	return &response, nil
+}
+
+func updateOpenWebUIChat(chatId string, history History) error {
+	return postOpenWebUIChat(chatId, "", OpenWebUIChatUpdateRequest{
+		Chat: ChatHistoryUpdate{
+			Messages: historyBranch(history),
+			History:  history,
+		},
+	})
+}
+
+func renameOpenWebUIChat(chatId string, title string) error {
+	return postOpenWebUIChat(chatId, "", OpenWebUIChatRenameRequest{Chat: ChatTitleUpdate{Title: title}})
+}
+
+// Open WebUI toggles a chat's archived state, there is no way to set it.
+func toggleOpenWebUIChatArchive(chatId string) error {
+	return postOpenWebUIChat(chatId, "/archive", nil)
+}
+
+func postOpenWebUIChat(chatId string, action string, update any) error {
+	apikey := os.Getenv("OPENWEBUI_API_KEY")
+	url := os.Getenv("OPENWEBUI_URL")
+
+	var body io.Reader
+	if update != nil {
+		updateBody, _ := json.Marshal(update)
+		body = bytes.NewBuffer(updateBody)
+	}
+	req, err := http.NewRequest(
+		"POST",
+		"http://"+url+"/api/v1/chats/"+chatId+action,
+		body,
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+apikey)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	fmt.Println("Chat update response status:", resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return errors.New("Open WebUI returned " + resp.Status + ": " + string(body))
+	}
+	return nil
+}
+
+// Tells Open WebUI a response is finished so it can run its outlet filters
+// and any post-processing, as the web UI does after every reply.
+func sendCompletedToOpenWebUI(session *Session, history History) {
+	apikey := os.Getenv("OPENWEBUI_API_KEY")
+	url := os.Getenv("OPENWEBUI_URL")
+
+	messages := []OpenWebUIMessage{}
+	for _, message := range historyBranch(history) {
+		messages = append(messages, OpenWebUIMessage{
+			ID:        message.ID,
+			Role:      message.Role,
+			Content:   message.Content,
+			Timestamp: message.Timestamp,
+		})
+	}
+	completed := OpenWebUIChatCompletedRequest{
+		Model:    session.completionModel(),
+		Messages: messages,
+		ChatID:   session.ChatID,
+		ID:       *history.CurrentID,
+	}
+	completedBody, _ := json.Marshal(completed)
+	req, err := http.NewRequest(
+		"POST",
+		"http://"+url+"/api/chat/completed",
+		bytes.NewBuffer(completedBody),
+	)
+	if err != nil {
+		log.Println("Failed to build completed request:", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+apikey)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println("Error sending completed request:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	fmt.Println("Chat completed response status:", resp.Status)
 }
 
 func sendFileToOpenWebUI(filename string) string {
@@ -341,13 +732,98 @@ func sendFileToOpenWebUI(filename string) string {
 	return response.ID
 }
 
-func getOpenWebUIResponse(messageText string, attachments []Attachment) string {
-	if len(attachments) > 0 {
-		fmt.Println("Files: ", attachments)
-		fileIds := uploadFiles(attachments)
-		return sendToOpenWebUI(messageText, fileIds)
+// Returns the model's reply. When onUpdate is set the reply is streamed and
+// onUpdate is called with the partial text as it is generated. Both sides of
+// the exchange are recorded in the Open WebUI chat, and the model is given the
+// conversation so far as context. If replaceId is set the exchange replaces
+// the turn starting at that user message, branching off before it the way
+// the web UI does when a message is edited.
+func getOpenWebUIResponse(session *Session, messageText string, attachments []Attachment, replaceId string, onUpdate func(text string)) *OpenWebUIReply {
+	// Looked up at most once per message, since it fetches every model.
+	var vision *bool
+	supportsVision := func() bool {
+		if vision == nil {
+			supported := modelSupportsVision(session.completionModel())
+			vision = &supported
+		}
+		return *vision
+	}
+
+	documents, images := splitImageAttachments(attachments)
+	if len(images) > 0 && !supportsVision() {
+		return &OpenWebUIReply{
+			Content: "The model " + session.completionModel() + " can't look at images. Switch to a vision model with !model load, or describe the image in text instead.",
+			Failed:  true,
+		}
+	}
+
+	var fileIds []string
+	if len(documents) > 0 {
+		fmt.Println("Files: ", documents)
+		fileIds = uploadFiles(documents)
+	}
+	imageURLs := signalImageURLs(images)
+
+	// If the chat can't be loaded still answer, just without the history.
+	var history *History
+	chat, err := getOpenWebUIChat(session.ChatID)
+	if err != nil {
+		log.Println("Failed to load chat history, continuing without it:", err)
+	} else {
+		history = &chat.Chat.History
+	}
+
+	var messages []OpenWebUIMessage
+	var questionId string
+	if history != nil {
+		if replaced, ok := history.Messages[replaceId]; ok {
+			history.CurrentID = replaced.ParentID
+		}
+		questionId = appendHistoryMessage(history, HistoryMessage{
+			Role:    "user",
+			Content: messageText,
+			Models:  []string{session.completionModel()},
+			Files:   append(openWebUIFiles(fileIds), imageFiles(imageURLs)...),
+		})
+		messages = contextMessages(session, *history)
+		// Earlier images are only useful, and only accepted, by vision models.
+		if len(images) == 0 && hasImages(messages) && !supportsVision() {
+			messages = withoutImages(messages)
+		}
+	} else {
+		messages = []OpenWebUIMessage{{Role: "user", Content: messageText, Images: imageURLs}}
+	}
+
+	var reply *OpenWebUIReply
+	if onUpdate != nil {
+		reply, err = streamFromOpenWebUI(session, messages, fileIds, onUpdate)
+	} else {
+		reply, err = sendToOpenWebUI(session, messages, fileIds)
+	}
+	if err != nil {
+		log.Println("Error getting completion:", err)
+		return &OpenWebUIReply{Content: "Failed to get a response from Open WebUI, check server logs for details.", Failed: true}
 	}
-	return sendToOpenWebUI(messageText, nil)
+
+	if history != nil {
+		messageId := appendHistoryMessage(history, HistoryMessage{
+			Role:    "assistant",
+			Content: reply.Content,
+			Model:   session.completionModel(),
+			Sources: reply.Sources,
+			Files:   reply.Files,
+			Done:    true,
+		})
+		if err := updateOpenWebUIChat(session.ChatID, *history); err != nil {
+			log.Println("Failed to save chat history:", err)
+		} else {
+			reply.MessageID = messageId
+			reply.QuestionID = questionId
+			sendCompletedToOpenWebUI(session, *history)
+		}
+	}
+
+	return reply
 }
 
 func uploadFiles(attachments []Attachment) []string {
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Room left on every page for the "(1/3)" header and the !more hint.
+const pageOverhead = 60
+
+// Longest message sent in one go. Signal clients collapse longer messages
+// behind "Read more", so replies are split well before that.
+func maxMessageChars() int {
+	return envInt("SIGNAL_MAX_MESSAGE_CHARS", 2000)
+}
+
+// Splits a reply into numbered pages of at most SIGNAL_MAX_MESSAGE_CHARS,
+// breaking between paragraphs where possible. Code blocks are only broken
+// when they don't fit on a page by themselves, and are then closed and
+// reopened so every page renders on its own.
+func paginate(text string) []string {
+	limit := max(maxMessageChars()-pageOverhead, 100)
+	pages := []string{}
+	current := ""
+	for _, block := range splitBlocks(text) {
+		for _, piece := range splitBlock(block, limit) {
+			if current != "" && utf8.RuneCountInString(current)+2+utf8.RuneCountInString(piece) > limit {
+				pages = append(pages, current)
+				current = ""
+			}
+			if current == "" {
+				current = piece
+			} else {
+				current += "\n\n" + piece
+			}
+		}
+	}
+	if current != "" || len(pages) == 0 {
+		pages = append(pages, current)
+	}
+
+	if len(pages) > 1 {
+		for index := range pages {
+			pages[index] = fmt.Sprintf("(%d/%d)\n%s", index+1, len(pages), pages[index])
+		}
+	}
+	return pages
+}
+
+// Splits markdown at blank lines, keeping each fenced code block together.
+func splitBlocks(text string) []string {
+	blocks := []string{}
+	current := []string{}
+	fence := ""
+	flush := func() {
+		if len(current) > 0 {
+			blocks = append(blocks, strings.Join(current, "\n"))
+			current = nil
+		}
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case fence != "":
+			current = append(current, line)
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+				flush()
+			}
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			flush()
+			fence = trimmed[:3]
+			current = append(current, line)
+		case trimmed == "":
+			flush()
+		default:
+			current = append(current, line)
+		}
+	}
+	flush()
+	return blocks
+}
+
+// Breaks a block that is too long for one page into pieces that fit.
+func splitBlock(block string, limit int) []string {
+	if utf8.RuneCountInString(block) <= limit {
+		return []string{block}
+	}
+
+	lines := strings.Split(block, "\n")
+	trimmed := strings.TrimSpace(lines[0])
+	if !strings.HasPrefix(trimmed, "```") && !strings.HasPrefix(trimmed, "~~~") {
+		return packLines(lines, limit)
+	}
+
+	opening, closing := lines[0], trimmed[:3]
+	// A fence whose opening line doesn't fit on a page can't be repeated on
+	// every page, so the block is split like plain text instead.
+	budget := limit - utf8.RuneCountInString(opening) - len(closing) - 2
+	if budget < 1 {
+		return packLines(lines, limit)
+	}
+	body := lines[1:]
+	if len(body) > 0 && strings.HasPrefix(strings.TrimSpace(body[len(body)-1]), closing) {
+		body = body[:len(body)-1]
+	}
+	pieces := []string{}
+	for _, piece := range packLines(body, budget) {
+		pieces = append(pieces, opening+"\n"+piece+"\n"+closing)
+	}
+	return pieces
+}
+
+// Joins lines into pieces of at most limit characters, splitting lines that
+// are too long by themselves between words.
+func packLines(lines []string, limit int) []string {
+	pieces := []string{}
+	current := ""
+	for _, line := range lines {
+		for _, part := range splitLine(line, limit) {
+			if current != "" && utf8.RuneCountInString(current)+1+utf8.RuneCountInString(part) > limit {
+				pieces = append(pieces, current)
+				current = ""
+			}
+			if current == "" {
+				current = part
+			} else {
+				current += "\n" + part
+			}
+		}
+	}
+	if current != "" {
+		pieces = append(pieces, current)
+	}
+	return pieces
+}
+
+func splitLine(line string, limit int) []string {
+	limit = max(limit, 1)
+	parts := []string{}
+	runes := []rune(line)
+	for len(runes) > limit {
+		cut := limit
+		for index := limit; index > limit/2; index-- {
+			if runes[index] == ' ' {
+				cut = index
+				break
+			}
+		}
+		parts = append(parts, string(runes[:cut]))
+		runes = []rune(strings.TrimLeft(string(runes[cut:]), " "))
+	}
+	return append(parts, string(runes))
+}
+
+// Pages sent straight away. Any further pages wait for !more.
+func pagesPerReply() int {
+	return max(envInt("SIGNAL_PAGES_PER_REPLY", 3), 1)
+}
+
+// Takes the pages to send now and keeps the rest on the session for !more.
+// The last page sent says how to get the rest.
+func (s *Session) nextPages(pages []string) []string {
+	count := min(len(pages), pagesPerReply())
+	shown := append([]string{}, pages[:count]...)
+	s.morePages = pages[count:]
+	if len(s.morePages) > 0 {
+		shown[count-1] += fmt.Sprintf("\n\nSend !more for the rest (%d more pages).", len(s.morePages))
+	}
+	return shown
+}
+
+// Replies longer than SIGNAL_REPLY_FILE_CHARS are also sent whole as a
+// markdown file, which is easier to read or save than a run of messages.
+func replyFile(text string) *OutgoingAttachment {
+	threshold := envInt("SIGNAL_REPLY_FILE_CHARS", 0)
+	if threshold <= 0 || utf8.RuneCountInString(text) <= threshold {
+		return nil
+	}
+	return &OutgoingAttachment{Filename: "reply.md", ContentType: "text/markdown", Data: []byte(text)}
+}
+
+// Sends pages of a reply in order, attaching files to the last one. Returns
+// the timestamps of the messages sent.
+func sendReplyPages(pages []string, attachments []OutgoingAttachment, target ReplyTarget) []int64 {
+	timestamps := []int64{}
+	for index, page := range pages {
+		if index == len(pages)-1 {
+			timestamps = append(timestamps, sendSignalReply(page, attachments, target))
+		} else {
+			timestamps = append(timestamps, sendSignalReply(page, nil, target))
+		}
+	}
+	return timestamps
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestPaginate(t *testing.T) {
+	t.Setenv("SIGNAL_MAX_MESSAGE_CHARS", "2000")
+
+	tests := []struct {
+		name  string
+		text  string
+		pages int
+	}{
+		{"short reply", "Hello there.", 1},
+		{"paragraphs", strings.Repeat(strings.Repeat("word ", 100)+"\n\n", 10), 4},
+		{"long fence opening", "```python " + strings.Repeat("y", 1930) + "\n" + strings.Repeat("print(1)\n", 300) + "```", 3},
+		{"fence opening at the limit", "```" + strings.Repeat("y", 1932) + "\n" + strings.Repeat("x = 1\n", 400) + "```", 3},
+		{"long code block", "```go\n" + strings.Repeat("fmt.Println(\"hello\")\n", 300) + "```", 4},
+		{"long single line", strings.Repeat("a", 5000), 3},
+		{"long single word line", strings.Repeat("abcdefghij ", 500), 3},
+		{"multibyte text", strings.Repeat("日本語のテキスト ", 600), 3},
+		{"emoji", strings.Repeat("👍", 4500), 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pages := paginate(test.text)
+			if len(pages) != test.pages {
+				t.Errorf("got %d pages, want %d", len(pages), test.pages)
+			}
+			for index, page := range pages {
+				if !utf8.ValidString(page) {
+					t.Errorf("page %d is not valid UTF-8", index+1)
+				}
+				if length := utf8.RuneCountInString(page); length > maxMessageChars() {
+					t.Errorf("page %d has %d characters, more than %d", index+1, length, maxMessageChars())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Most stop sequences OpenAI compatible backends accept.
+const maxStopSequences = 4
+
+// GenerationParams are the sampling settings a sender can change with !set.
+// Nil fields are left out of completion requests so the model's defaults
+// apply.
+type GenerationParams struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+var paramNames = []string{"temperature", "top_p", "max_tokens", "seed", "stop"}
+
+// The parameters sent with completions. A persona's temperature replaces the
+// sender's, like its model does.
+func (s *Session) generationParams() GenerationParams {
+	params := s.Params
+	params.Stop = slices.Clone(s.Params.Stop)
+	if persona := s.persona(); persona != nil && persona.Temperature != nil {
+		params.Temperature = persona.Temperature
+	}
+	return params
+}
+
+// Sets one parameter from its text form, or resets it to the model's default
+// for "default" or "off".
+func (p *GenerationParams) set(name string, value string) error {
+	reset := value == "default" || value == "off"
+	switch name {
+	case "temperature":
+		if reset {
+			p.Temperature = nil
+			return nil
+		}
+		number, err := parseFloatInRange(value, 0, 2)
+		if err != nil {
+			return errors.New("temperature must be a number from 0 to 2.")
+		}
+		p.Temperature = &number
+	case "top_p":
+		if reset {
+			p.TopP = nil
+			return nil
+		}
+		number, err := parseFloatInRange(value, 0, 1)
+		if err != nil {
+			return errors.New("top_p must be a number from 0 to 1.")
+		}
+		p.TopP = &number
+	case "max_tokens":
+		if reset {
+			p.MaxTokens = nil
+			return nil
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 || number > 131072 {
+			return errors.New("max_tokens must be a whole number from 1 to 131072.")
+		}
+		p.MaxTokens = &number
+	case "seed":
+		if reset {
+			p.Seed = nil
+			return nil
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return errors.New("seed must be a whole number of 0 or more.")
+		}
+		p.Seed = &number
+	case "stop":
+		if reset {
+			p.Stop = nil
+			return nil
+		}
+		stop, err := parseStopSequences(value)
+		if err != nil {
+			return err
+		}
+		p.Stop = stop
+	default:
+		return fmt.Errorf("Unknown parameter %q.", name)
+	}
+	return nil
+}
+
+func parseFloatInRange(value string, low float64, high float64) (float64, error) {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if number < low || number > high {
+		return 0, fmt.Errorf("%v is out of range", number)
+	}
+	return number, nil
+}
+
+// Stop sequences are separated by commas. "\n" stands for a line break since
+// Signal messages can't end in one.
+func parseStopSequences(value string) ([]string, error) {
+	stop := []string{}
+	for _, sequence := range strings.Split(value, ",") {
+		sequence = strings.ReplaceAll(strings.TrimSpace(sequence), `\n`, "\n")
+		if sequence != "" {
+			stop = append(stop, sequence)
+		}
+	}
+	if len(stop) == 0 {
+		return nil, errors.New("Give at least one stop sequence.")
+	}
+	if len(stop) > maxStopSequences {
+		return nil, fmt.Errorf("At most %d stop sequences can be set.", maxStopSequences)
+	}
+	return stop, nil
+}
+
+// The value of one parameter as shown to the user.
+func (p GenerationParams) describe(name string) string {
+	switch name {
+	case "temperature":
+		return formatFloatParam(p.Temperature)
+	case "top_p":
+		return formatFloatParam(p.TopP)
+	case "max_tokens":
+		return formatIntParam(p.MaxTokens)
+	case "seed":
+		return formatIntParam(p.Seed)
+	case "stop":
+		if len(p.Stop) == 0 {
+			return "default"
+		}
+		quoted := []string{}
+		for _, sequence := range p.Stop {
+			quoted = append(quoted, strconv.Quote(sequence))
+		}
+		return strings.Join(quoted, ", ")
+	}
+	return ""
+}
+
+func formatFloatParam(value *float64) string {
+	if value == nil {
+		return "default"
+	}
+	return strconv.FormatFloat(*value, 'f', -1, 64)
+}
+
+func formatIntParam(value *int) string {
+	if value == nil {
+		return "default"
+	}
+	return strconv.Itoa(*value)
+}
+
+func handleSetCommand(ctx *CommandContext, args []string) string {
+	session := ctx.Session
+	name := strings.ToLower(args[0])
+	value := strings.TrimSpace(args[1])
+	if err := session.Params.set(name, value); err != nil {
+		return err.Error()
+	}
+	session.save()
+
+	reply := name + " set to " + session.Params.describe(name) + "."
+	if name == "temperature" && session.generationParams().Temperature != session.Params.Temperature {
+		reply += " The " + session.Persona + " persona's temperature is used while it is active."
+	}
+	return reply
+}
+
+func handleParamsCommand(ctx *CommandContext, args []string) string {
+	session := ctx.Session
+	params := session.generationParams()
+	lines := []string{"Generation parameters:"}
+	for _, name := range paramNames {
+		line := name + ": " + params.describe(name)
+		if name == "temperature" && params.Temperature != session.Params.Temperature {
+			line += " (from the " + session.Persona + " persona)"
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "Send !set <parameter> <value> to change one, or !set <parameter> default to reset it.")
+	return strings.Join(lines, "\n")
+}
+
+func handleParamsResetCommand(ctx *CommandContext, args []string) string {
+	ctx.Session.Params = GenerationParams{}
+	ctx.Session.save()
+	return "Generation parameters reset to the model's defaults."
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Persona is an admin defined preset that users can switch to. Empty fields
+// leave the user's own settings in place.
+type Persona struct {
+	Description  string   `json:"description,omitempty"`
+	SystemPrompt string   `json:"system_prompt,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	Temperature  *float64 `json:"temperature,omitempty"`
+}
+
+// PersonaSet holds the personas read from PERSONAS_PATH, a JSON object
+// mapping each persona's name to its settings.
+type PersonaSet struct {
+	mu       sync.RWMutex
+	path     string
+	personas map[string]Persona
+}
+
+func loadPersonas() *PersonaSet {
+	set := &PersonaSet{path: envString("PERSONAS_PATH", "personas.json"), personas: map[string]Persona{}}
+	if err := set.reload(); err != nil {
+		log.Println("No personas loaded:", err)
+	}
+	return set
+}
+
+func (p *PersonaSet) reload() error {
+	fileBytes, err := os.ReadFile(p.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s does not exist", p.path)
+	}
+	if err != nil {
+		return err
+	}
+	personas := map[string]Persona{}
+	if err := json.Unmarshal(fileBytes, &personas); err != nil {
+		return fmt.Errorf("%s is not valid: %w", p.path, err)
+	}
+
+	// Names are matched case insensitively.
+	normalised := map[string]Persona{}
+	for name, persona := range personas {
+		normalised[strings.ToLower(name)] = persona
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.personas = normalised
+	log.Printf("Loaded %d personas from %s.", len(normalised), p.path)
+	return nil
+}
+
+func (p *PersonaSet) get(name string) (Persona, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	persona, ok := p.personas[strings.ToLower(name)]
+	return persona, ok
+}
+
+func (p *PersonaSet) names() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	names := []string{}
+	for name := range p.personas {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Returns the session's active persona, or nil if it has none or the persona
+// has since been removed.
+func (s *Session) persona() *Persona {
+	if s.Persona == "" || s.manager == nil || s.manager.personas == nil {
+		return nil
+	}
+	persona, ok := s.manager.personas.get(s.Persona)
+	if !ok {
+		return nil
+	}
+	return &persona
+}
+
+// The model completions are requested from: the persona's, if it sets one.
+func (s *Session) completionModel() string {
+	if persona := s.persona(); persona != nil && persona.Model != "" {
+		return persona.Model
+	}
+	return s.Model
+}
+
+// The persona's instructions come first, followed by the user's own prompt.
+func (s *Session) systemPrompt() string {
+	prompts := []string{}
+	if persona := s.persona(); persona != nil && persona.SystemPrompt != "" {
+		prompts = append(prompts, persona.SystemPrompt)
+	}
+	if s.SystemPrompt != "" {
+		prompts = append(prompts, s.SystemPrompt)
+	}
+	return strings.Join(prompts, "\n\n")
+}
+
+func handlePromptCommand(ctx *CommandContext, args []string) string {
+	return handlePromptShowCommand(ctx, args)
+}
+
+func handlePromptShowCommand(ctx *CommandContext, args []string) string {
+	session := ctx.Session
+	if session.SystemPrompt == "" {
+		return "You have no system prompt set. Use !prompt set <instructions> to add one."
+	}
+	return "Your system prompt:\n" + session.SystemPrompt
+}
+
+func handlePromptSetCommand(ctx *CommandContext, args []string) string {
+	ctx.Session.SystemPrompt = args[0]
+	ctx.Session.save()
+	return "System prompt set. It will be sent with every message in your chats."
+}
+
+func handlePromptClearCommand(ctx *CommandContext, args []string) string {
+	ctx.Session.SystemPrompt = ""
+	ctx.Session.save()
+	return "System prompt cleared."
+}
+
+// Switches to the named persona, or describes the current one.
+func handlePersonaCommand(ctx *CommandContext, args []string) string {
+	session := ctx.Session
+	personas := session.manager.personas
+	if args[0] == "" {
+		if session.persona() == nil {
+			return "No persona is active. " + describePersonas(personas)
+		}
+		return "Your persona is " + session.Persona + ". " + describePersonas(personas)
+	}
+
+	name := strings.ToLower(args[0])
+	persona, ok := personas.get(name)
+	if !ok {
+		return "There is no persona called " + args[0] + ". " + describePersonas(personas)
+	}
+	session.Persona = name
+	session.save()
+
+	reply := "Switched to the " + name + " persona."
+	if persona.Model != "" {
+		reply += " It uses " + persona.Model + "."
+	}
+	return reply
+}
+
+func handlePersonaListCommand(ctx *CommandContext, args []string) string {
+	personas := ctx.Session.manager.personas
+	names := personas.names()
+	if len(names) == 0 {
+		return "No personas have been set up."
+	}
+
+	lines := []string{"Personas:"}
+	for _, name := range names {
+		persona, _ := personas.get(name)
+		line := name
+		if persona.Description != "" {
+			line += " - " + persona.Description
+		}
+		if name == ctx.Session.Persona {
+			line += " (current)"
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "Send !persona <name> to switch.")
+	return strings.Join(lines, "\n")
+}
+
+func handlePersonaOffCommand(ctx *CommandContext, args []string) string {
+	ctx.Session.Persona = ""
+	ctx.Session.save()
+	return "Persona turned off, your own model and prompt are used again."
+}
+
+func handlePersonaReloadCommand(ctx *CommandContext, args []string) string {
+	personas := ctx.Session.manager.personas
+	if err := personas.reload(); err != nil {
+		log.Println("Failed to reload personas:", err)
+		return "Failed to reload personas: " + err.Error()
+	}
+	return fmt.Sprintf("Reloaded %d personas.", len(personas.names()))
+}
+
+func describePersonas(personas *PersonaSet) string {
+	names := personas.names()
+	if len(names) == 0 {
+		return "No personas have been set up."
+	}
+	return "Available: " + strings.Join(names, ", ") + "."
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// CommandContext is what a command handler gets to work with besides its
+// arguments.
+type CommandContext struct {
+	Session       *Session
+	Sender        Sender
+	AccountNumber string
+	// Where the command's own messages go, quoting the command.
+	Reply ReplyTarget
+	// The sender's name, or the group's, used to title new chats.
+	ChatTitle   string
+	Access      *AccessControl
+	Registry    *CommandRegistry
+	Synthesizer Synthesizer
+}
+
+// Argument describes one positional argument of a command.
+type Argument struct {
+	Name     string
+	Required bool
+	// If set, the argument must be one of these values.
+	Choices []string
+	// Consumes every remaining word, so it must be the last argument.
+	Rest bool
+	// Optional extra check, the returned error is shown to the user.
+	Validate func(value string) error
+}
+
+// Command is a "!" command. A command with subcommands runs its own handler
+// only when no subcommand matches the first argument.
+type Command struct {
+	Name        string
+	Aliases     []string
+	Description string
+	Args        []Argument
+	Subcommands []*Command
+	Run         func(ctx *CommandContext, args []string) string
+	// Only admins may run this command and its subcommands.
+	Admin bool
+
+	parent *Command
+}
+
+type CommandRegistry struct {
+	commands []*Command
+	byName   map[string]*Command
+}
+
+func newCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{byName: make(map[string]*Command)}
+}
+
+func (r *CommandRegistry) register(command *Command) {
+	for _, name := range append([]string{command.Name}, command.Aliases...) {
+		if _, exists := r.byName[name]; exists {
+			panic("command registered twice: " + name)
+		}
+		r.byName[name] = command
+	}
+	linkSubcommands(command)
+	r.commands = append(r.commands, command)
+}
+
+func linkSubcommands(command *Command) {
+	for _, subcommand := range command.Subcommands {
+		subcommand.parent = command
+		linkSubcommands(subcommand)
+	}
+}
+
+func (r *CommandRegistry) lookup(name string) *Command {
+	return r.byName[strings.ToLower(name)]
+}
+
+func (c *Command) subcommand(name string) *Command {
+	name = strings.ToLower(name)
+	for _, subcommand := range c.Subcommands {
+		if subcommand.Name == name || slices.Contains(subcommand.Aliases, name) {
+			return subcommand
+		}
+	}
+	return nil
+}
+
+func (c *Command) adminOnly() bool {
+	return c.Admin || (c.parent != nil && c.parent.adminOnly())
+}
+
+// The full invocation, e.g. "!model load".
+func (c *Command) path() string {
+	if c.parent == nil {
+		return "!" + c.Name
+	}
+	return c.parent.path() + " " + c.Name
+}
+
+func (c *Command) usage() string {
+	parts := []string{c.path()}
+	for _, argument := range c.Args {
+		name := argument.Name
+		if len(argument.Choices) > 0 {
+			name = strings.Join(argument.Choices, " | ")
+		}
+		if argument.Rest {
+			name += "..."
+		}
+		if argument.Required {
+			parts = append(parts, "<"+name+">")
+		} else {
+			parts = append(parts, "["+name+"]")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Parses and runs a message starting with "!", returning the reply.
+func (r *CommandRegistry) execute(ctx *CommandContext, textMessage string) string {
+	fields, rests := splitCommand(strings.TrimPrefix(textMessage, "!"))
+	if len(fields) == 0 {
+		return "Send !help for a list of commands."
+	}
+
+	command := r.lookup(fields[0])
+	if command == nil {
+		return "Unknown command !" + fields[0] + ". Send !help for a list of commands."
+	}
+	args, rests := fields[1:], rests[1:]
+	for len(args) > 0 {
+		subcommand := command.subcommand(args[0])
+		if subcommand == nil {
+			break
+		}
+		command = subcommand
+		args, rests = args[1:], rests[1:]
+	}
+
+	if command.adminOnly() && !ctx.Access.isAdmin(ctx.Sender) {
+		log.Println(ctx.Sender, "tried to run admin command", command.path())
+		return "Only admins can use " + command.path() + "."
+	}
+	if command.Run == nil {
+		return r.describe(command)
+	}
+	args, err := command.parseArgs(args, rests)
+	if err != nil && len(command.Subcommands) > 0 {
+		return err.Error() + "\n" + r.describe(command)
+	}
+	if err != nil {
+		return err.Error() + "\nUsage: " + command.usage()
+	}
+	return command.Run(ctx, args)
+}
+
+// Splits a command into words. rests[i] is the message from word i on with
+// its original spacing and line breaks, which Rest arguments take whole.
+func splitCommand(text string) (words []string, rests []string) {
+	start := -1
+	for index, r := range text + " " {
+		switch {
+		case unicode.IsSpace(r) && start >= 0:
+			words = append(words, text[start:index])
+			start = -1
+		case !unicode.IsSpace(r) && start < 0:
+			start = index
+			rests = append(rests, strings.TrimRightFunc(text[index:], unicode.IsSpace))
+		}
+	}
+	return words, rests
+}
+
+// Checks the arguments against the command's schema. The returned slice has
+// one entry per declared argument, empty for optional ones that were left out.
+func (c *Command) parseArgs(args []string, rests []string) ([]string, error) {
+	if len(c.Args) == 0 && len(c.Subcommands) > 0 && len(args) > 0 {
+		return nil, fmt.Errorf("Unknown option %q for %s.", args[0], c.path())
+	}
+
+	parsed := make([]string, len(c.Args))
+	for index, argument := range c.Args {
+		if index >= len(args) {
+			if argument.Required {
+				return nil, fmt.Errorf("Missing %s.", argument.Name)
+			}
+			continue
+		}
+
+		value := args[index]
+		if argument.Rest {
+			value = rests[index]
+		}
+		if len(argument.Choices) > 0 && !slices.Contains(argument.Choices, strings.ToLower(value)) {
+			return nil, fmt.Errorf("%q isn't a valid %s.", value, argument.Name)
+		}
+		if argument.Validate != nil {
+			if err := argument.Validate(value); err != nil {
+				return nil, err
+			}
+		}
+		parsed[index] = value
+	}
+
+	if len(args) > len(c.Args) && (len(c.Args) == 0 || !c.Args[len(c.Args)-1].Rest) {
+		return nil, fmt.Errorf("Too many arguments for %s.", c.path())
+	}
+	return parsed, nil
+}
+
+// Lists every top level command, or describes one command in detail.
+// Admin commands are only listed for admins.
+func (r *CommandRegistry) help(topic []string, admin bool) string {
+	if len(topic) == 0 {
+		lines := []string{"Commands:"}
+		for _, command := range r.commands {
+			if command.Admin && !admin {
+				continue
+			}
+			lines = append(lines, command.summary())
+		}
+		lines = append(lines, "Send !help <command> for details.")
+		return strings.Join(lines, "\n")
+	}
+
+	command := r.lookup(strings.TrimPrefix(topic[0], "!"))
+	if command == nil || (command.Admin && !admin) {
+		return "Unknown command " + topic[0] + ". Send !help for a list of commands."
+	}
+	for _, name := range topic[1:] {
+		subcommand := command.subcommand(name)
+		if subcommand == nil {
+			break
+		}
+		command = subcommand
+	}
+	return r.describe(command)
+}
+
+func (c *Command) summary() string {
+	name := c.path()
+	if len(c.Aliases) > 0 {
+		name += " (!" + strings.Join(c.Aliases, ", !") + ")"
+	}
+	if c.Admin {
+		name += " [admin]"
+	}
+	return name + " - " + c.Description
+}
+
+func (r *CommandRegistry) describe(command *Command) string {
+	lines := []string{command.Description}
+	if command.Run != nil {
+		lines = append(lines, "Usage: "+command.usage())
+	}
+	if command.parent == nil && len(command.Aliases) > 0 {
+		lines = append(lines, "Aliases: !"+strings.Join(command.Aliases, ", !"))
+	}
+	for _, subcommand := range command.Subcommands {
+		line := subcommand.usage() + " - " + subcommand.Description
+		if subcommand.Admin {
+			line += " [admin]"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Session holds everything needed to talk to Open WebUI on behalf of one
+// conversation (a direct message sender or a group). It is passed explicitly
+// to the command and Open WebUI code so settings never leak between users.
+type Session struct {
+	Recipient    string
+	ChatID       string
+	Chats        []ChatRef
+	Model        string
+	WebSearch    bool
+	SystemPrompt string
+	// ID of the last history message trimmed from the model's context with
+	// !c; empty when the whole conversation is in context.
+	ContextStart string
+	// Replies are also sent as spoken audio.
+	Voice bool
+	// Name of the persona in use, see persona.go.
+	Persona string
+	// Sampling settings changed with !set, see params.go.
+	Params GenerationParams
+
+	createdAt time.Time
+	manager   *SessionManager
+	// Pages of the last reply still to be sent with !more. Not persisted.
+	morePages []string
+	// Recent replies by the timestamp of the Signal message holding them,
+	// for rating with reactions. Not persisted either.
+	replies    map[int64]ReplyRef
+	replyOrder []int64
+	// Recent questions by their Signal timestamp, for edits and deletes.
+	questions     map[int64]QuestionRef
+	questionOrder []int64
+	lastQuestion  int64
+}
+
+// SessionManager loads sessions from the store and keeps them cached for the
+// lifetime of the process.
+type SessionManager struct {
+	mu               sync.Mutex
+	store            Store
+	defaultModel     string
+	defaultWebSearch bool
+	sessions         map[string]*Session
+	personas         *PersonaSet
+}
+
+func newSessionManager(store Store, defaultModel string, personas *PersonaSet) *SessionManager {
+	return &SessionManager{
+		store:            store,
+		personas:         personas,
+		defaultModel:     defaultModel,
+		defaultWebSearch: os.Getenv("OPENWEBUI_WEB_SEARCH") == "1",
+		sessions:         make(map[string]*Session),
+	}
+}
+
+// Returns the session for a recipient. Sessions without a ChatID have not
+// had an Open WebUI chat created for them yet.
+func (m *SessionManager) get(recipient string) *Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if session, ok := m.sessions[recipient]; ok {
+		return session
+	}
+
+	record, err := m.store.Get(recipient)
+	if err != nil {
+		log.Println("Failed to load record for "+recipient+", starting fresh:", err)
+	}
+	if record == nil {
+		record = &SenderRecord{
+			Recipient: recipient,
+			Preferences: Preferences{
+				WebSearch: m.defaultWebSearch,
+			},
+			CreatedAt: time.Now(),
+		}
+	}
+
+	session := &Session{
+		Recipient:    recipient,
+		ChatID:       record.ChatID,
+		Chats:        slices.Clone(record.Chats),
+		Model:        record.Model,
+		WebSearch:    record.Preferences.WebSearch,
+		SystemPrompt: record.Preferences.SystemPrompt,
+		ContextStart: record.Preferences.ContextStart,
+		Voice:        record.Preferences.Voice,
+		Persona:      record.Preferences.Persona,
+		Params:       record.Preferences.Params,
+		createdAt:    record.CreatedAt,
+		manager:      m,
+	}
+	m.sessions[recipient] = session
+	// Records from before senders could have several chats only know the
+	// current one.
+	if session.ChatID != "" && session.chat(session.ChatID) == nil {
+		session.Chats = append(session.Chats, ChatRef{ID: session.ChatID, Title: "Chat", CreatedAt: session.createdAt})
+		m.put(session)
+	}
+	if session.Model == "" {
+		session.Model = m.defaultModel
+		m.put(session)
+	}
+
+	return session
+}
+
+func (s *Session) save() {
+	m := s.manager
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.put(s)
+}
+
+func (m *SessionManager) put(session *Session) {
+	m.updateLocked(session.Recipient, func(record *SenderRecord) {
+		record.ChatID = session.ChatID
+		record.Chats = slices.Clone(session.Chats)
+		record.Model = session.Model
+		record.Preferences = Preferences{
+			WebSearch:    session.WebSearch,
+			SystemPrompt: session.SystemPrompt,
+			ContextStart: session.ContextStart,
+			Voice:        session.Voice,
+			Persona:      session.Persona,
+			Params:       session.Params,
+		}
+		record.CreatedAt = session.createdAt
+	})
+}
+
+// Applies a change to a recipient's stored record, creating the record if
+// needed. Fields not owned by Session are only ever changed this way.
+func (m *SessionManager) update(recipient string, change func(record *SenderRecord)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.updateLocked(recipient, change)
+}
+
+func (m *SessionManager) updateLocked(recipient string, change func(record *SenderRecord)) {
+	record, err := m.store.Get(recipient)
+	if err != nil {
+		log.Println("Failed to load record for "+recipient+":", err)
+		return
+	}
+	if record == nil {
+		record = &SenderRecord{
+			Recipient: recipient,
+			Preferences: Preferences{
+				WebSearch: m.defaultWebSearch,
+			},
+			CreatedAt: time.Now(),
+		}
+	}
+
+	change(record)
+	record.UpdatedAt = time.Now()
+	err = m.store.Put(record)
+	if err != nil {
+		log.Println("Failed to save record for "+recipient+". Check that this program has sufficient privileges to write to the store.", err)
+	}
+}
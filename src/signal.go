@@ -3,12 +3,17 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
 )
 
 type Attachment struct {
@@ -22,13 +27,61 @@ type Attachment struct {
 	UploadTimestamp int64   `json:"uploadTimestamp"`
 }
 
+type GroupInfo struct {
+	GroupID   string `json:"groupId"`
+	GroupName string `json:"groupName"`
+	Revision  int    `json:"revision"`
+	Type      string `json:"type"`
+}
+
+type DataMention struct {
+	Name   string `json:"name"`
+	Number string `json:"number"`
+	Uuid   string `json:"uuid"`
+	Start  int    `json:"start"`
+	Length int    `json:"length"`
+}
+
+type Quote struct {
+	ID           int64  `json:"id"`
+	Author       string `json:"author"`
+	AuthorNumber string `json:"authorNumber"`
+	AuthorUuid   string `json:"authorUuid"`
+	Text         string `json:"text"`
+}
+
+// A reaction to a message. Reactions arrive as data messages of their own.
+type Reaction struct {
+	Emoji               string `json:"emoji"`
+	TargetAuthor        string `json:"targetAuthor"`
+	TargetAuthorNumber  string `json:"targetAuthorNumber"`
+	TargetAuthorUuid    string `json:"targetAuthorUuid"`
+	TargetSentTimestamp int64  `json:"targetSentTimestamp"`
+	IsRemove            bool   `json:"isRemove"`
+}
+
+type RemoteDelete struct {
+	Timestamp int64 `json:"timestamp"`
+}
+
+// An edit replaces the whole message sent at TargetSentTimestamp.
+type EditMessage struct {
+	TargetSentTimestamp int64        `json:"targetSentTimestamp"`
+	DataMessage         *DataMessage `json:"dataMessage"`
+}
+
 type DataMessage struct {
-	Timestamp          int64        `json:"timestamp"`
-	Message            string       `json:"message"`
-	ExpiresInSeconds   int          `json:"expiresInSeconds"`
-	IsExpirationUpdate bool         `json:"isExpirationUpdate"`
-	ViewOnce           bool         `json:"viewOnce"`
-	Attachments        []Attachment `json:"attachments"`
+	Timestamp          int64         `json:"timestamp"`
+	Message            string        `json:"message"`
+	ExpiresInSeconds   int           `json:"expiresInSeconds"`
+	IsExpirationUpdate bool          `json:"isExpirationUpdate"`
+	ViewOnce           bool          `json:"viewOnce"`
+	Attachments        []Attachment  `json:"attachments"`
+	GroupInfo          *GroupInfo    `json:"groupInfo,omitempty"`
+	Mentions           []DataMention `json:"mentions,omitempty"`
+	Quote              *Quote        `json:"quote,omitempty"`
+	Reaction           *Reaction     `json:"reaction,omitempty"`
+	RemoteDelete       *RemoteDelete `json:"remoteDelete,omitempty"`
 }
 
 type Envelope struct {
@@ -41,6 +94,7 @@ type Envelope struct {
 	ServerReceived  int64        `json:"serverReceivedTimestamp"`
 	ServerDelivered int64        `json:"serverDeliveredTimestamp"`
 	DataMessage     *DataMessage `json:"dataMessage"`
+	EditMessage     *EditMessage `json:"editMessage,omitempty"`
 }
 
 type LinkPreview struct {
@@ -80,6 +134,62 @@ type SignalMessageResponse struct {
 	ViewOnce       bool           `json:"view_once,omitempty"`
 }
 
+// ReplyTarget is where a reply goes and, when it answers a message, the
+// message it quotes.
+type ReplyTarget struct {
+	Account   string
+	Recipient string
+	Quote     *OutgoingQuote
+}
+
+type OutgoingQuote struct {
+	Author    string
+	Timestamp int64
+	Message   string
+}
+
+// Replies quote the message they answer so it's clear which answer belongs
+// to which question in a busy chat.
+func newReplyTarget(account string, recipient string, sender Sender, message *DataMessage) ReplyTarget {
+	return ReplyTarget{
+		Account:   account,
+		Recipient: recipient,
+		Quote: &OutgoingQuote{
+			Author:    sender.id(),
+			Timestamp: message.Timestamp,
+			Message:   message.Message,
+		},
+	}
+}
+
+// Addresses a message to the target, quoting the message being answered.
+func (t ReplyTarget) address(signalMessage SignalMessageResponse) SignalMessageResponse {
+	signalMessage.Number = t.Account
+	signalMessage.Recipients = []string{t.Recipient}
+	if t.Quote != nil {
+		signalMessage.QuoteAuthor = t.Quote.Author
+		signalMessage.QuoteTimestamp = t.Quote.Timestamp
+		signalMessage.QuoteMessage = t.Quote.Message
+	}
+	return signalMessage
+}
+
+type SignalReactionRequest struct {
+	Reaction     string `json:"reaction"`
+	Recipient    string `json:"recipient"`
+	TargetAuthor string `json:"target_author"`
+	Timestamp    int64  `json:"timestamp"`
+}
+
+type SignalRemoteDeleteRequest struct {
+	Recipient string `json:"recipient"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type SignalSendResponse struct {
+	Timestamp string `json:"timestamp"`
+}
+
 type SignalTypingRequest struct {
 	Recipient string `json:"recipient"`
 }
@@ -89,6 +199,134 @@ type SignalMessage struct {
 	Account  string   `json:"account"`
 }
 
+// Signal replaces each mention in the message body with this placeholder and
+// describes it in DataMessage.Mentions.
+const mentionPlaceholder = "\uFFFC"
+
+// The REST API addresses groups as "group." followed by the base64 encoded
+// internal group ID that signal-cli reports in groupInfo.
+func groupRecipient(groupId string) string {
+	return "group." + base64.StdEncoding.EncodeToString([]byte(groupId))
+}
+
+// Returns who a reply to this envelope should be sent to, which doubles as the
+// key for the conversation in the store.
+func conversationRecipient(envelope Envelope) string {
+	if dataMessage := envelope.activeDataMessage(); dataMessage != nil && dataMessage.GroupInfo != nil {
+		return groupRecipient(dataMessage.GroupInfo.GroupID)
+	}
+	return envelopeSender(envelope).id()
+}
+
+// The message an envelope carries: the new version of the message for an
+// edit, otherwise its data message.
+func (e Envelope) activeDataMessage() *DataMessage {
+	if e.EditMessage != nil && e.EditMessage.DataMessage != nil {
+		return e.EditMessage.DataMessage
+	}
+	return e.DataMessage
+}
+
+// Sender identifies the person who sent a message. Users who hide their
+// phone number are only known by their UUID.
+type Sender struct {
+	Number string
+	Uuid   string
+	Name   string
+}
+
+func envelopeSender(envelope Envelope) Sender {
+	return Sender{
+		Number: envelope.SourceNumber,
+		Uuid:   envelope.SourceUuid,
+		Name:   envelope.SourceName,
+	}
+}
+
+// The identifier used to message the sender directly.
+func (s Sender) id() string {
+	if s.Number != "" {
+		return s.Number
+	}
+	return s.Uuid
+}
+
+func (s Sender) String() string {
+	if s.Name == "" {
+		return s.id()
+	}
+	return s.Name + " (" + s.id() + ")"
+}
+
+func isOwnAccount(number, uuid, accountNumber string) bool {
+	if number != "" && number == accountNumber {
+		return true
+	}
+	accountUuid := os.Getenv("SIGNAL_UUID")
+	return uuid != "" && accountUuid != "" && uuid == accountUuid
+}
+
+// In groups the bot only answers messages that @mention it or quote-reply to
+// one of its own messages.
+func isAddressedToAccount(message *DataMessage, accountNumber string) bool {
+	if message.GroupInfo == nil {
+		return true
+	}
+	for _, mention := range message.Mentions {
+		if isOwnAccount(mention.Number, mention.Uuid, accountNumber) {
+			return true
+		}
+	}
+	if message.Quote != nil {
+		return isOwnAccount(message.Quote.AuthorNumber, message.Quote.AuthorUuid, accountNumber)
+	}
+	return false
+}
+
+// When a message quote-replies to one of the bot's answers, the quoted part
+// is passed on to the model ahead of the message so it knows what is being
+// referred to, even if that answer is no longer in context.
+func withQuotedReply(message *DataMessage, text string, accountNumber string) string {
+	quote := message.Quote
+	if quote == nil || strings.TrimSpace(quote.Text) == "" || !isOwnAccount(quote.AuthorNumber, quote.AuthorUuid, accountNumber) {
+		return text
+	}
+	lines := strings.Split(strings.TrimSpace(quote.Text), "\n")
+	for index, line := range lines {
+		lines[index] = "> " + line
+	}
+	return "Replying to your earlier message:\n" + strings.Join(lines, "\n") + "\n\n" + text
+}
+
+// Replaces mention placeholders with readable names, dropping mentions of the
+// bot itself. Mention offsets are in UTF-16 code units.
+func resolveMentions(message *DataMessage, accountNumber string) string {
+	if len(message.Mentions) == 0 {
+		return message.Message
+	}
+
+	text := utf16.Encode([]rune(message.Message))
+	var builder strings.Builder
+	position := 0
+	for _, mention := range message.Mentions {
+		if mention.Start < position || mention.Start+mention.Length > len(text) {
+			continue
+		}
+		builder.WriteString(string(utf16.Decode(text[position:mention.Start])))
+		if !isOwnAccount(mention.Number, mention.Uuid, accountNumber) {
+			name := mention.Name
+			if name == "" {
+				name = mention.Number
+			}
+			builder.WriteString("@" + name)
+		}
+		position = mention.Start + mention.Length
+	}
+	builder.WriteString(string(utf16.Decode(text[position:])))
+
+	return strings.TrimSpace(strings.ReplaceAll(builder.String(), mentionPlaceholder, ""))
+}
+
 func getSignalAttachment(attachmentId string) string {
 	signalUrl := os.Getenv("SIGNAL_URL")
 	out, err := os.Create(attachmentId)
@@ -166,16 +404,127 @@ func sendTypingIndicator(action string, accountNumber string, sender string) {
 	}()
 }
 
-func sendSignalMessage(message string, account string, sender string) {
+// Reacts to the message a reply target quotes. Reacting again replaces the
+// earlier reaction. Set SIGNAL_REACTIONS=0 to turn acknowledgements off.
+func sendSignalReaction(emoji string, target ReplyTarget) {
+	if os.Getenv("SIGNAL_REACTIONS") == "0" || target.Quote == nil {
+		return
+	}
+	reactionBody, _ := json.Marshal(SignalReactionRequest{
+		Reaction:     emoji,
+		Recipient:    target.Recipient,
+		TargetAuthor: target.Quote.Author,
+		Timestamp:    target.Quote.Timestamp,
+	})
 	signalUrl := os.Getenv("SIGNAL_URL")
-	signalMessage := SignalMessageResponse{
+	go func() {
+		req, err := http.NewRequest(
+			"POST",
+			"http://"+signalUrl+"/v1/reactions/"+target.Account,
+			bytes.NewBuffer(reactionBody),
+		)
+		if err != nil {
+			log.Println("Failed to build reaction request:", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		client := &http.Client{}
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Println("Error sending reaction:", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		fmt.Println("Reaction response status:", resp.Status)
+	}()
+}
+
+// Deletes a message we sent for everyone in the conversation.
+func deleteSignalMessage(timestamp int64, account string, recipient string) {
+	signalUrl := os.Getenv("SIGNAL_URL")
+
+	deleteBody, _ := json.Marshal(SignalRemoteDeleteRequest{Recipient: recipient, Timestamp: timestamp})
+	req, err := http.NewRequest(
+		"DELETE",
+		"http://"+signalUrl+"/v1/remote-delete/"+account,
+		bytes.NewBuffer(deleteBody),
+	)
+	if err != nil {
+		log.Println("Failed to build remote delete request:", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error sending remote delete:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	fmt.Println("Remote delete response status:", resp.Status)
+}
+
+// Sends a message and returns its timestamp, which Signal uses to identify
+// the message for edits, quotes and reactions. Returns 0 if sending failed.
+func sendSignalMessage(message string, account string, sender string) int64 {
+	return postSignalMessage(SignalMessageResponse{
 		Message:    message,
 		Number:     account,
 		Recipients: []string{sender},
+	})
+}
+
+// Sends a plain text reply, optionally with files attached. The message text
+// may be empty.
+func sendSignalAttachments(message string, attachments []OutgoingAttachment, target ReplyTarget) int64 {
+	return postSignalMessage(target.address(SignalMessageResponse{
+		Base64Attachments: encodeAttachments(attachments),
+		Message:           message,
+	}))
+}
+
+// Sends a model's reply, converting its markdown to Signal's styled text.
+func sendSignalReply(reply string, attachments []OutgoingAttachment, target ReplyTarget) int64 {
+	message, textMode := styleReply(reply)
+	return postSignalMessage(target.address(SignalMessageResponse{
+		Base64Attachments: encodeAttachments(attachments),
+		Message:           message,
+		TextMode:          textMode,
+	}))
+}
+
+// Replaces the text of a reply we previously sent. The quote is sent again
+// since an edit replaces the whole message.
+func editSignalMessage(reply string, target ReplyTarget, timestamp int64) int64 {
+	message, textMode := styleReply(reply)
+	return postSignalMessage(target.address(SignalMessageResponse{
+		Message:       message,
+		EditTimestamp: timestamp,
+		TextMode:      textMode,
+	}))
+}
+
+func encodeAttachments(attachments []OutgoingAttachment) []string {
+	encoded := []string{}
+	for _, attachment := range attachments {
+		encoded = append(encoded, attachment.dataURI())
 	}
+	return encoded
+}
+
+func postSignalMessage(signalMessage SignalMessageResponse) int64 {
+	signalUrl := os.Getenv("SIGNAL_URL")
 
 	messageBody, _ := json.Marshal(signalMessage)
-	fmt.Println("Message Body:", string(messageBody))
+	if len(signalMessage.Base64Attachments) > 0 {
+		fmt.Printf("Message Body: %s (with %d attachments)\n", signalMessage.Message, len(signalMessage.Base64Attachments))
+	} else {
+		fmt.Println("Message Body:", string(messageBody))
+	}
 	req, err := http.NewRequest(
 		"POST",
 		"http://"+signalUrl+"/v2/send",
@@ -192,7 +541,7 @@ func sendSignalMessage(message string, account string, sender string) {
 	resp, err := client.Do(req)
 	if err != nil {
 		fmt.Println("Error sending request:", err)
-		return
+		return 0
 	}
 	defer resp.Body.Close()
 
@@ -202,4 +551,118 @@ func sendSignalMessage(message string, account string, sender string) {
 		fmt.Fprintln(os.Stdout, string(resp.Status))
 		bufio.NewWriter(os.Stdout).Flush()
 	}
+
+	body, err := io.ReadAll(resp.Body)
+	var response SignalSendResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		fmt.Println("Error unmarshalling JSON:", err)
+		return 0
+	}
+	timestamp, _ := strconv.ParseInt(response.Timestamp, 10, 64)
+
+	return timestamp
+}
+
+// Signal only lets a message be edited a limited number of times.
+const maxSignalEdits = 10
+
+// StreamingReply delivers a response that is still being generated as a single
+// Signal message: the first chunk is sent as a new message, which is then
+// edited at most once per interval until the response is finished.
+type StreamingReply struct {
+	target    ReplyTarget
+	interval  time.Duration
+	timestamp int64
+	sentText  string
+	lastSent  time.Time
+	edits     int
+	// The first chunk failed to send, so the response is only sent once
+	// it is finished.
+	failed bool
+}
+
+func newStreamingReply(target ReplyTarget) *StreamingReply {
+	interval := 2 * time.Second
+	if value := os.Getenv("SIGNAL_EDIT_INTERVAL_MS"); value != "" {
+		milliseconds, err := strconv.Atoi(value)
+		if err != nil {
+			log.Println("Invalid SIGNAL_EDIT_INTERVAL_MS, using default:", value)
+		} else {
+			interval = time.Duration(milliseconds) * time.Millisecond
+		}
+	}
+	return &StreamingReply{target: target, interval: interval}
+}
+
+// Continues an earlier reply, so the response replaces its text with edits
+// instead of being sent as a new message. edits is how often that message
+// has been edited already, which counts towards Signal's limit.
+func (r *StreamingReply) resume(timestamp int64, edits int) {
+	r.timestamp = timestamp
+	r.edits = edits
+}
+
+// Whether the first chunk has been delivered yet.
+func (r *StreamingReply) started() bool {
+	return r.timestamp != 0
+}
+
+// Shows the response so far. Only the first page is shown while streaming,
+// the rest is sent once the response is finished.
+func (r *StreamingReply) update(text string) {
+	text = paginate(text)[0]
+	if strings.TrimSpace(text) == "" || text == r.sentText {
+		return
+	}
+	if r.failed {
+		return
+	}
+	if !r.started() {
+		r.timestamp = sendSignalReply(text, nil, r.target)
+		r.sentText = text
+		r.lastSent = time.Now()
+		r.failed = r.timestamp == 0
+		return
+	}
+	// Keep the last edit in reserve for the finished response.
+	if time.Since(r.lastSent) < r.interval || r.edits >= maxSignalEdits-1 {
+		return
+	}
+	r.edit(text)
+}
+
+// Delivers the final pages: the streamed message becomes the first page and
+// the others follow as new messages. Attachments go out with the last page
+// unless that is the streamed message, since edits can't add files. Returns
+// the timestamps of the messages holding the pages.
+func (r *StreamingReply) finish(pages []string, attachments []OutgoingAttachment) []int64 {
+	if !r.started() {
+		return sendReplyPages(pages, attachments, r.target)
+	}
+	if pages[0] != r.sentText && r.edits >= maxSignalEdits {
+		// The message can't be edited any more, so the reply is sent anew
+		// and the stale one deleted.
+		deleteSignalMessage(r.timestamp, r.target.Account, r.target.Recipient)
+		timestamps := sendReplyPages(pages, attachments, r.target)
+		r.timestamp, r.sentText, r.edits = timestamps[0], pages[0], 0
+		return timestamps
+	}
+	if pages[0] != r.sentText {
+		r.edit(pages[0])
+	}
+	timestamps := []int64{r.timestamp}
+	if len(pages) > 1 {
+		timestamps = append(timestamps, sendReplyPages(pages[1:], attachments, r.target)...)
+	} else if len(attachments) > 0 {
+		sendSignalAttachments("", attachments, r.target)
+	}
+	return timestamps
+}
+
+func (r *StreamingReply) edit(text string) {
+	editSignalMessage(text, r.target, r.timestamp)
+	r.sentText = text
+	r.lastSent = time.Now()
+	r.edits++
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OpenWebUISource is one retrieval result attached to a completion. Its shape
+// depends on where it came from, so it is kept loosely typed and stored in
+// the chat history as received.
+type OpenWebUISource map[string]any
+
+type OpenWebUIReply struct {
+	Content string
+	Sources []OpenWebUISource
+	Files   []OpenWebUIFile
+	// IDs of the reply and the message it answers in the chat history, empty
+	// if they couldn't be saved.
+	MessageID  string
+	QuestionID string
+	// Set when Content explains why there is no answer.
+	Failed bool
+}
+
+// The reply as it should read in Signal, with any cited pages listed at the end.
+func (r *OpenWebUIReply) text() string {
+	return r.Content + formatCitations(r.Sources)
+}
+
+type Citation struct {
+	Title string
+	URL   string
+}
+
+// Pulls the linkable documents out of the sources, skipping duplicates and
+// anything without a URL (such as uploaded files).
+func sourceCitations(sources []OpenWebUISource) []Citation {
+	citations := []Citation{}
+	seen := map[string]bool{}
+	add := func(title, url string) {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return
+		}
+		if seen[url] {
+			return
+		}
+		seen[url] = true
+		citations = append(citations, Citation{Title: strings.TrimSpace(title), URL: url})
+	}
+
+	for _, source := range sources {
+		metadata, _ := source["metadata"].([]any)
+		for _, entry := range metadata {
+			fields, ok := entry.(map[string]any)
+			if !ok {
+				continue
+			}
+			url, _ := fields["source"].(string)
+			title, _ := fields["title"].(string)
+			if title == "" {
+				title, _ = fields["name"].(string)
+			}
+			add(title, url)
+		}
+
+		origin, _ := source["source"].(map[string]any)
+		urls, _ := origin["urls"].([]any)
+		for _, url := range urls {
+			if url, ok := url.(string); ok {
+				add("", url)
+			}
+		}
+	}
+
+	return citations
+}
+
+// Returns a numbered list of cited web pages to append to a reply, or nothing
+// if the reply didn't use any.
+func formatCitations(sources []OpenWebUISource) string {
+	citations := sourceCitations(sources)
+	if len(citations) == 0 {
+		return ""
+	}
+
+	lines := []string{"\n\nSources:"}
+	for index, citation := range citations {
+		if citation.Title == "" || citation.Title == citation.URL {
+			lines = append(lines, fmt.Sprintf("%d. %s", index+1, citation.URL))
+		} else {
+			lines = append(lines, fmt.Sprintf("%d. %s - %s", index+1, citation.Title, citation.URL))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Synthesizer turns a reply into spoken audio, returning the audio and its
+// content type.
+type Synthesizer interface {
+	Synthesize(text string) ([]byte, string, error)
+}
+
+// Uses the text to speech engine configured in Open WebUI's audio settings.
+type OpenWebUISynthesizer struct {
+	Voice string
+}
+
+// Talks to any server implementing OpenAI's /audio/speech endpoint.
+type OpenAISynthesizer struct {
+	URL    string
+	APIKey string
+	Model  string
+	Voice  string
+}
+
+type SpeechRequest struct {
+	Model          string `json:"model,omitempty"`
+	Input          string `json:"input"`
+	Voice          string `json:"voice,omitempty"`
+	ResponseFormat string `json:"response_format,omitempty"`
+}
+
+// Picks the backend from TTS_BACKEND. Returns nil when speech is turned off,
+// in which case !voice can't be enabled.
+func newSynthesizer() Synthesizer {
+	switch backend := envString("TTS_BACKEND", "openwebui"); backend {
+	case "openwebui":
+		return OpenWebUISynthesizer{Voice: os.Getenv("TTS_VOICE")}
+	case "openai":
+		tts := OpenAISynthesizer{
+			URL:    strings.TrimSuffix(os.Getenv("TTS_URL"), "/"),
+			APIKey: os.Getenv("TTS_API_KEY"),
+			Model:  envString("TTS_MODEL", "tts-1"),
+			Voice:  envString("TTS_VOICE", "alloy"),
+		}
+		if tts.URL == "" {
+			log.Fatal("TTS_BACKEND is openai but TTS_URL is not set.")
+		}
+		return tts
+	case "off":
+		return nil
+	default:
+		log.Fatalf("Unknown TTS_BACKEND %q, expected openwebui, openai or off.", backend)
+		return nil
+	}
+}
+
+func (s OpenWebUISynthesizer) Synthesize(text string) ([]byte, string, error) {
+	url := "http://" + os.Getenv("OPENWEBUI_URL") + "/api/v1/audio/speech"
+	return postSpeech(url, os.Getenv("OPENWEBUI_API_KEY"), SpeechRequest{Input: text, Voice: s.Voice})
+}
+
+func (s OpenAISynthesizer) Synthesize(text string) ([]byte, string, error) {
+	request := SpeechRequest{Model: s.Model, Input: text, Voice: s.Voice, ResponseFormat: "aac"}
+	return postSpeech(s.URL+"/audio/speech", s.APIKey, request)
+}
+
+func postSpeech(url string, apikey string, speech SpeechRequest) ([]byte, string, error) {
+	requestBody, _ := json.Marshal(speech)
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, "", err
+	}
+	if apikey != "" {
+		req.Header.Set("Authorization", "Bearer "+apikey)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	fmt.Println("Speech response status:", resp.Status)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errors.New("speech server returned " + resp.Status + ": " + string(body))
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+var markdownSymbolRegex = regexp.MustCompile("```[a-z]*|[*_`#>]+")
+
+// Drops markdown symbols that would otherwise be read out, and keeps the text
+// within TTS_MAX_CHARS since speech APIs limit how much they accept at once.
+func speechText(text string) string {
+	text = strings.TrimSpace(markdownSymbolRegex.ReplaceAllString(text, ""))
+	limit := envInt("TTS_MAX_CHARS", 4000)
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	text = string(runes[:limit])
+	if cut := strings.LastIndexAny(text, ".!?\n"); cut > limit/2 {
+		text = text[:cut+1]
+	}
+	return text
+}
+
+// Sends a spoken copy of a reply. Failures are only logged since the reply
+// has already been sent as text.
+func sendVoiceReply(synthesizer Synthesizer, text string, target ReplyTarget) {
+	text = speechText(text)
+	if text == "" {
+		return
+	}
+	audio, contentType, err := synthesizer.Synthesize(text)
+	if err != nil {
+		log.Println("Failed to synthesize voice reply:", err)
+		return
+	}
+	attachment := newOutgoingAttachment("reply", contentType, audio)
+	sendSignalAttachments("", []OutgoingAttachment{*attachment}, target)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Bumped whenever SenderRecord changes in a way that needs migrating.
+const storeSchemaVersion = 1
+
+type Preferences struct {
+	WebSearch    bool             `json:"web_search"`
+	SystemPrompt string           `json:"system_prompt,omitempty"`
+	ContextStart string           `json:"context_start,omitempty"`
+	Voice        bool             `json:"voice,omitempty"`
+	Persona      string           `json:"persona,omitempty"`
+	Params       GenerationParams `json:"params"`
+}
+
+// ChatRef is one of a sender's Open WebUI chats.
+type ChatRef struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Archived  bool      `json:"archived,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SenderRecord is everything persisted for one conversation, keyed by the
+// recipient replies are sent to (a phone number or a group).
+type SenderRecord struct {
+	Recipient string `json:"recipient"`
+	// The chat messages currently go to, one of Chats.
+	ChatID      string      `json:"chat_id"`
+	Chats       []ChatRef   `json:"chats,omitempty"`
+	Model       string      `json:"model"`
+	Preferences Preferences `json:"preferences"`
+	// One of the Access* constants, set by the invite flow in access.go.
+	Access    string    `json:"access,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Records hold slices, so a plain struct copy would share them.
+func (r *SenderRecord) clone() *SenderRecord {
+	copied := *r
+	copied.Chats = slices.Clone(r.Chats)
+	copied.Preferences.Params.Stop = slices.Clone(r.Preferences.Params.Stop)
+	return &copied
+}
+
+// Store persists sender records. Get returns nil without an error for
+// recipients that have no record yet.
+type Store interface {
+	Get(recipient string) (*SenderRecord, error)
+	Put(record *SenderRecord) error
+	List() ([]*SenderRecord, error)
+	Close() error
+}
+
+// Opens the backend selected by STORE_BACKEND and imports accounts.json and
+// models.json from older versions if they are still around.
+func openStore() (Store, error) {
+	var store Store
+	var err error
+	switch backend := os.Getenv("STORE_BACKEND"); backend {
+	case "", "file":
+		store, err = openFileStore(envString("STORE_PATH", "store.json"))
+	case "bolt":
+		store, err = openBoltStore(envString("STORE_PATH", "store.db"))
+	default:
+		return nil, fmt.Errorf("unknown STORE_BACKEND %q, expected file or bolt", backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateLegacyFiles(store); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+type fileStoreContents struct {
+	Version int                      `json:"version"`
+	Records map[string]*SenderRecord `json:"records"`
+}
+
+// FileStore keeps every record in a single JSON file that is rewritten
+// atomically on each change.
+type FileStore struct {
+	mu       sync.Mutex
+	path     string
+	contents fileStoreContents
+}
+
+func openFileStore(path string) (*FileStore, error) {
+	store := &FileStore{
+		path: path,
+		contents: fileStoreContents{
+			Version: storeSchemaVersion,
+			Records: map[string]*SenderRecord{},
+		},
+	}
+
+	fileBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Println(path + " does not exist, it will be created.")
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(fileBytes, &store.contents); err != nil {
+		return nil, fmt.Errorf("%s is corrupt, fix or remove it: %w", path, err)
+	}
+	if store.contents.Version > storeSchemaVersion {
+		return nil, fmt.Errorf("%s has schema version %d, this build only understands up to %d", path, store.contents.Version, storeSchemaVersion)
+	}
+	if store.contents.Records == nil {
+		store.contents.Records = map[string]*SenderRecord{}
+	}
+	store.contents.Version = storeSchemaVersion
+
+	return store, nil
+}
+
+func (s *FileStore) Get(recipient string) (*SenderRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.contents.Records[recipient]
+	if !ok {
+		return nil, nil
+	}
+	return record.clone(), nil
+}
+
+func (s *FileStore) Put(record *SenderRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.contents.Records[record.Recipient]
+	s.contents.Records[record.Recipient] = record.clone()
+	if err := s.write(); err != nil {
+		if existed {
+			s.contents.Records[record.Recipient] = previous
+		} else {
+			delete(s.contents.Records, record.Recipient)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) List() ([]*SenderRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := []*SenderRecord{}
+	for _, record := range s.contents.Records {
+		records = append(records, record.clone())
+	}
+	return records, nil
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// Writes to a temporary file next to the store and renames it into place, so
+// a crash mid-write never leaves a truncated store behind.
+func (s *FileStore) write() error {
+	contents, err := json.MarshalIndent(s.contents, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(contents); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), 0660); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), s.path)
+}
+
+// Imports the accounts.json and models.json maps used before the store
+// existed, then renames them so they are only imported once.
+func migrateLegacyFiles(store Store) error {
+	accounts, err := readLegacyFile("accounts.json")
+	if err != nil {
+		return err
+	}
+	models, err := readLegacyFile("models.json")
+	if err != nil {
+		return err
+	}
+	if accounts == nil && models == nil {
+		return nil
+	}
+
+	recipients := map[string]bool{}
+	for recipient := range accounts {
+		recipients[recipient] = true
+	}
+	for recipient := range models {
+		recipients[recipient] = true
+	}
+
+	now := time.Now()
+	for recipient := range recipients {
+		existing, err := store.Get(recipient)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+		err = store.Put(&SenderRecord{
+			Recipient: recipient,
+			ChatID:    accounts[recipient],
+			Model:     models[recipient],
+			Preferences: Preferences{
+				WebSearch: os.Getenv("OPENWEBUI_WEB_SEARCH") == "1",
+			},
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, filename := range []string{"accounts.json", "models.json"} {
+		if _, err := os.Stat(filename); err == nil {
+			if err := os.Rename(filename, filename+".migrated"); err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("Migrated %d senders from accounts.json and models.json.", len(recipients))
+
+	return nil
+}
+
+func readLegacyFile(filename string) (map[string]string, error) {
+	fileBytes, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	contents := map[string]string{}
+	// Older versions created these files empty before anything was written.
+	if len(fileBytes) == 0 {
+		return contents, nil
+	}
+	if err := json.Unmarshal(fileBytes, &contents); err != nil {
+		return nil, fmt.Errorf("%s is corrupt, fix or remove it before migrating: %w", filename, err)
+	}
+	return contents, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltMetaBucket    = []byte("meta")
+	boltSendersBucket = []byte("senders")
+	boltVersionKey    = []byte("version")
+)
+
+// BoltStore keeps records in an embedded bbolt database, one JSON encoded
+// record per key.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0660, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(boltSendersBucket); err != nil {
+			return err
+		}
+
+		if value := meta.Get(boltVersionKey); value != nil {
+			version, err := strconv.Atoi(string(value))
+			if err != nil {
+				return fmt.Errorf("%s has an unreadable schema version %q", path, value)
+			}
+			if version > storeSchemaVersion {
+				return fmt.Errorf("%s has schema version %d, this build only understands up to %d", path, version, storeSchemaVersion)
+			}
+		}
+		return meta.Put(boltVersionKey, []byte(strconv.Itoa(storeSchemaVersion)))
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Get(recipient string) (*SenderRecord, error) {
+	var record *SenderRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltSendersBucket).Get([]byte(recipient))
+		if value == nil {
+			return nil
+		}
+		record = &SenderRecord{}
+		return json.Unmarshal(value, record)
+	})
+	return record, err
+}
+
+func (s *BoltStore) Put(record *SenderRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSendersBucket).Put([]byte(record.Recipient), value)
+	})
+}
+
+func (s *BoltStore) List() ([]*SenderRecord, error) {
+	records := []*SenderRecord{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSendersBucket).ForEach(func(key, value []byte) error {
+			record := &SenderRecord{}
+			if err := json.Unmarshal(value, record); err != nil {
+				return fmt.Errorf("record for %s is corrupt: %w", key, err)
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
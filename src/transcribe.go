@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+)
+
+// Transcriber turns a recorded voice note into text.
+type Transcriber interface {
+	Transcribe(filename string, contentType string) (string, error)
+}
+
+// Uses the speech to text engine configured in Open WebUI's audio settings.
+type OpenWebUITranscriber struct{}
+
+// Talks to any server implementing OpenAI's /audio/transcriptions endpoint,
+// such as a local faster-whisper or whisper.cpp server.
+type OpenAITranscriber struct {
+	URL    string
+	APIKey string
+	Model  string
+}
+
+type TranscriptionResponse struct {
+	Text string `json:"text"`
+}
+
+// Picks the backend from STT_BACKEND. Returns nil when transcription is
+// turned off, in which case voice notes are treated like any other file.
+func newTranscriber() Transcriber {
+	switch backend := envString("STT_BACKEND", "openwebui"); backend {
+	case "openwebui":
+		return OpenWebUITranscriber{}
+	case "openai":
+		stt := OpenAITranscriber{
+			URL:    strings.TrimSuffix(os.Getenv("STT_URL"), "/"),
+			APIKey: os.Getenv("STT_API_KEY"),
+			Model:  envString("STT_MODEL", "whisper-1"),
+		}
+		if stt.URL == "" {
+			log.Fatal("STT_BACKEND is openai but STT_URL is not set.")
+		}
+		return stt
+	case "off":
+		return nil
+	default:
+		log.Fatalf("Unknown STT_BACKEND %q, expected openwebui, openai or off.", backend)
+		return nil
+	}
+}
+
+func (OpenWebUITranscriber) Transcribe(filename string, contentType string) (string, error) {
+	url := "http://" + os.Getenv("OPENWEBUI_URL") + "/api/v1/audio/transcriptions"
+	return postTranscription(url, os.Getenv("OPENWEBUI_API_KEY"), filename, contentType, nil)
+}
+
+func (t OpenAITranscriber) Transcribe(filename string, contentType string) (string, error) {
+	fields := map[string]string{"model": t.Model, "response_format": "json"}
+	return postTranscription(t.URL+"/audio/transcriptions", t.APIKey, filename, contentType, fields)
+}
+
+func postTranscription(url string, apikey string, filename string, contentType string, fields map[string]string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// Servers check the type of the uploaded part and often the file
+	// extension too, and Signal attachment IDs don't always have one.
+	name := path.Base(filename)
+	if path.Ext(name) == "" {
+		if extensions, err := mime.ExtensionsByType(contentType); err == nil && len(extensions) > 0 {
+			name += extensions[0]
+		}
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for key, value := range fields {
+		writer.WriteField(key, value)
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, name))
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return "", err
+	}
+	writer.Close()
+
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return "", err
+	}
+	if apikey != "" {
+		req.Header.Set("Authorization", "Bearer "+apikey)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	fmt.Println("Transcription response status:", resp.Status)
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("transcription server returned " + resp.Status + ": " + string(respBody))
+	}
+	var response TranscriptionResponse
+	if err := json.Unmarshal(respBody, &response); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response.Text), nil
+}
+
+func isVoiceNote(attachment Attachment) bool {
+	return strings.HasPrefix(attachment.ContentType, "audio/")
+}
+
+// Replaces voice notes with their transcripts. Returns the text to send to
+// the model, the attachments that are left, and the transcripts on their own
+// so they can be echoed back to the sender.
+func transcribeVoiceNotes(transcriber Transcriber, textMessage string, attachments []Attachment) (string, []Attachment, []string, error) {
+	if transcriber == nil {
+		return textMessage, attachments, nil, nil
+	}
+
+	remaining := []Attachment{}
+	transcripts := []string{}
+	for _, attachment := range attachments {
+		if !isVoiceNote(attachment) {
+			remaining = append(remaining, attachment)
+			continue
+		}
+
+		contentType := getSignalAttachment(attachment.ID)
+		if !strings.HasPrefix(contentType, "audio/") {
+			contentType = attachment.ContentType
+		}
+		transcript, err := transcriber.Transcribe(attachment.ID, contentType)
+		os.Remove(attachment.ID)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if transcript != "" {
+			transcripts = append(transcripts, transcript)
+		}
+	}
+
+	parts := []string{}
+	if strings.TrimSpace(textMessage) != "" {
+		parts = append(parts, textMessage)
+	}
+	parts = append(parts, transcripts...)
+	return strings.Join(parts, "\n\n"), remaining, transcripts, nil
+}
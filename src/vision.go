@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"os"
+	"strings"
+)
+
+// Separates photos, which vision models look at directly, from documents,
+// which are uploaded to Open WebUI for retrieval.
+func splitImageAttachments(attachments []Attachment) (documents []Attachment, images []Attachment) {
+	for _, attachment := range attachments {
+		if strings.HasPrefix(attachment.ContentType, "image/") {
+			images = append(images, attachment)
+		} else {
+			documents = append(documents, attachment)
+		}
+	}
+	return documents, images
+}
+
+// Open WebUI treats models as vision capable unless they have been
+// configured otherwise, so models it doesn't describe are assumed to be too.
+// If the model list can't be fetched the model is given the benefit of the
+// doubt and any error comes from the completion instead.
+func modelSupportsVision(id string) bool {
+	model, err := getOpenWebUIModel(id)
+	if err != nil {
+		log.Println("Failed to look up capabilities of "+id+":", err)
+		return true
+	}
+	if model == nil || model.Info == nil {
+		return true
+	}
+	vision, ok := model.Info.Meta.Capabilities["vision"]
+	return !ok || vision
+}
+
+// Downloads images from Signal and returns them as data URIs.
+func signalImageURLs(images []Attachment) []string {
+	urls := []string{}
+	for _, image := range images {
+		contentType := getSignalAttachment(image.ID)
+		data, err := os.ReadFile(image.ID)
+		os.Remove(image.ID)
+		if err != nil {
+			log.Println("Failed to read image "+image.ID+":", err)
+			continue
+		}
+		if contentType == "" || !strings.HasPrefix(contentType, "image/") {
+			contentType = image.ContentType
+		}
+		urls = append(urls, "data:"+contentType+";base64,"+base64.StdEncoding.EncodeToString(data))
+	}
+	return urls
+}
+
+// Images are stored in the chat the same way the web UI stores them, so
+// they show up there and can be sent again as context.
+func imageFiles(urls []string) []OpenWebUIFile {
+	files := []OpenWebUIFile{}
+	for _, url := range urls {
+		files = append(files, OpenWebUIFile{Type: "image", URL: url})
+	}
+	return files
+}
+
+func historyImages(message HistoryMessage) []string {
+	var images []string
+	for _, file := range message.Files {
+		if file.Type == "image" && file.URL != "" && message.Role == "user" {
+			images = append(images, file.URL)
+		}
+	}
+	return images
+}
+
+func hasImages(messages []OpenWebUIMessage) bool {
+	for _, message := range messages {
+		if len(message.Images) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutImages(messages []OpenWebUIMessage) []OpenWebUIMessage {
+	stripped := []OpenWebUIMessage{}
+	for _, message := range messages {
+		message.Images = nil
+		stripped = append(stripped, message)
+	}
+	return stripped
+}